@@ -0,0 +1,505 @@
+// Rawlite-csv imports CSV and TSV files into a new SQLite database.
+//
+// Usage:
+//
+//	rawlite-csv [flags] -o out.db file.csv...
+//
+// Each file is imported into a table named after the file, without its extension,
+// unless -table names a single table for all of them.
+// Two files that would be imported into tables with the same name are an error,
+// reported before anything is written; use -table to import them into one table.
+// The first row of each file names the columns, unless -noheader is given.
+// Rows are stored in the order they appear, with rowids counting up from 1.
+// With -o -, the database is written to standard output once it is complete,
+// for example to pipe it to gzip.
+//
+// The type of each column is INTEGER, REAL, or TEXT,
+// inferred from the first -infer rows of the first file of the table,
+// and values are converted the way SQLite converts text inserted into a column of that type.
+// Empty fields are stored as NULL, except in TEXT columns.
+//
+// Alternatively, -schema names a JSON file describing the columns,
+// in the form of a rawlite.Schema:
+//
+//	{"Columns": [{"Name": "id", "Type": "INTEGER", "PrimaryKey": true}, {"Name": "name", "Type": "TEXT", "NotNull": true}], "Strict": true}
+//
+// Every row is checked against the schema.
+// The values of an INTEGER PRIMARY KEY column are the rowids,
+// so they must be increasing integers.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"iter"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	output     = flag.String("o", "", "write the database to `file`, or to standard output if it is -")
+	force      = flag.Bool("f", false, "overwrite the output file if it exists")
+	table      = flag.String("table", "", "import every file into the table `name`")
+	schemaFile = flag.String("schema", "", "read the columns from the JSON `file` instead of inferring them")
+	separator  = flag.String("sep", "", "field separator (default tab for .tsv files, comma otherwise)")
+	noHeader   = flag.Bool("noheader", false, "the files have no header row; name the columns c1, c2, ...")
+	inferRows  = flag.Int("infer", 1000, "infer column types from the first `n` rows")
+	pageSize   = flag.Int("pagesize", 65536, "database page size")
+	workers    = flag.Int("workers", 0, "number of encoding workers (default GOMAXPROCS)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -o out.db file.csv...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !rawlite.ValidPageSize(*pageSize) {
+		fmt.Fprintf(os.Stderr, "rawlite-csv: invalid page size %d\n", *pageSize)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "rawlite-csv:", err)
+		os.Exit(1)
+	}
+}
+
+// options holds the settings for importing tables, given by the flags.
+type options struct {
+	// schema is the schema read from -schema, or nil to infer the schema of each table.
+	schema    *rawlite.Schema
+	separator string
+	noHeader  bool
+	inferRows int
+	workers   int
+}
+
+func run(ctx context.Context) error {
+	opts := &options{
+		separator: *separator,
+		noHeader:  *noHeader,
+		inferRows: *inferRows,
+		workers:   *workers,
+	}
+	if *schemaFile != "" {
+		var err error
+		if opts.schema, err = readSchema(*schemaFile); err != nil {
+			return err
+		}
+	}
+	tables, err := groupFiles(flag.Args(), *table)
+	if err != nil {
+		return err
+	}
+
+	// Canceling ctx makes the Database fail,
+	// so that no partial database is written when an import fails.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	db, f, err := createOutput(ctx)
+	if err != nil {
+		return err
+	}
+	err = importFiles(ctx, cancel, db, tables, opts)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+	return err
+}
+
+// createOutput opens the database on the output file, which it returns to be closed after the database,
+// or on standard output if the output file is "-", in which case the file is nil.
+func createOutput(ctx context.Context) (*rawlite.Database, *os.File, error) {
+	if *output == "-" {
+		return rawlite.OpenDatabaseWriterContext(ctx, os.Stdout, rawlite.PageSize(*pageSize)), nil, nil
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*output, flags, 0o666)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawlite.OpenDatabaseContext(ctx, f, rawlite.PageSize(*pageSize)), f, nil
+}
+
+// readSchema reads a schema from the JSON file name.
+func readSchema(name string) (*rawlite.Schema, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	schema := &rawlite.Schema{}
+	if err := json.Unmarshal(b, schema); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := schema.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return schema, nil
+}
+
+// tableFiles is a table and the files imported into it.
+type tableFiles struct {
+	name  string
+	files []string
+}
+
+// groupFiles returns the tables that files are imported into:
+// a table named table holding all of them, or if table is empty,
+// a table for each file named after it, in the order of files.
+// It returns an error if two files would be imported into tables with the same name.
+func groupFiles(files []string, table string) ([]tableFiles, error) {
+	if table != "" {
+		return []tableFiles{{table, files}}, nil
+	}
+
+	var tables []tableFiles
+	seen := make(map[string]string)
+	for _, name := range files {
+		table := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+		// SQLite's table names are case-insensitive.
+		key := strings.ToLower(table)
+		if other, ok := seen[key]; ok {
+			return nil, fmt.Errorf("%s and %s would both be imported into table %s; use -table to import them into one table", other, name, table)
+		}
+		seen[key] = name
+		tables = append(tables, tableFiles{table, []string{name}})
+	}
+	return tables, nil
+}
+
+// importFiles imports each table in turn into db,
+// calling cancel with the first error so that db fails.
+func importFiles(ctx context.Context, cancel context.CancelCauseFunc, db *rawlite.Database, tables []tableFiles, opts *options) error {
+	for _, table := range tables {
+		if err := importTable(ctx, cancel, db, table.name, table.files, opts); err != nil {
+			cancel(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// importTable imports files into a new table named table.
+// If opts.schema is nil, the columns are named by the header of the first file
+// and their types are inferred from its first rows.
+// If reading or encoding a row fails, importTable calls cancel with the error
+// before the table is closed, so the table is never added to the database.
+func importTable(ctx context.Context, cancel context.CancelCauseFunc, db *rawlite.Database, table string, files []string, opts *options) error {
+	src, err := openSource(files, opts)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	schema := opts.schema
+	if schema == nil {
+		sample, err := src.peek(opts.inferRows)
+		if err != nil {
+			return err
+		}
+		schema = inferSchema(src.header, sample)
+		if len(schema.Columns) == 0 {
+			return fmt.Errorf("%s: no rows to infer columns from", files[0])
+		}
+		if err := schema.Check(); err != nil {
+			return fmt.Errorf("%s: %w", files[0], err)
+		}
+	}
+	enc := newEncoder(schema)
+
+	var tableOpts []rawlite.TableOption
+	if opts.schema != nil {
+		tableOpts = append(tableOpts, rawlite.ValidateRows(*schema))
+	}
+	rows := func(yield func(int64, []string) bool) {
+		enc.rows(src)(yield)
+		if src.err != nil {
+			cancel(src.err)
+		}
+	}
+	encode := func(rec *record.Record, fields []string) error {
+		err := enc.encode(rec, fields)
+		if err != nil {
+			cancel(err)
+		}
+		return err
+	}
+	sql, err := schema.CreateTableSQL(table)
+	if err != nil {
+		return err
+	}
+	return rawlite.IngestOrdered(ctx, db.OpenTable(tableOpts...), table, sql, rows, opts.workers, encode)
+}
+
+// source reads the records of a table from a sequence of files.
+type source struct {
+	opts   *options
+	files  []string
+	file   *os.File
+	reader *csv.Reader
+	// header is the header row of the first file, or nil if opts.noHeader is set.
+	header []string
+	// width is the number of fields in the first record, if opts.noHeader is set.
+	width int
+	// peeked holds the records returned by peek, which next returns first.
+	peeked [][]string
+	// err is the first error reading the files, other than io.EOF.
+	err error
+}
+
+func openSource(files []string, opts *options) (*source, error) {
+	src := &source{opts: opts, files: files}
+	if err := src.nextFile(); err != nil {
+		src.close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// nextFile opens the next file and reads its header row.
+func (src *source) nextFile() error {
+	src.close()
+	name := src.files[0]
+	src.files = src.files[1:]
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	src.file = f
+
+	sep := ','
+	if strings.EqualFold(filepath.Ext(name), ".tsv") {
+		sep = '\t'
+	}
+	if src.opts.separator != "" {
+		if src.opts.separator == `\t` {
+			sep = '\t'
+		} else {
+			sep = []rune(src.opts.separator)[0]
+		}
+	}
+	src.reader = csv.NewReader(f)
+	src.reader.Comma = sep
+	src.reader.LazyQuotes = sep == '\t'
+
+	if src.opts.noHeader {
+		return nil
+	}
+	header, err := src.reader.Read()
+	if err == io.EOF {
+		return fmt.Errorf("%s: missing header row", name)
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if src.header == nil {
+		src.header = header
+	}
+	// Every file must have the same columns as the first,
+	// but csv.Reader only checks that the rest of this file matches its header.
+	if len(header) != len(src.header) {
+		return fmt.Errorf("%s: header has %d fields, want %d", name, len(header), len(src.header))
+	}
+	return nil
+}
+
+// next returns the next record, or false at the end of the files or after an error.
+func (src *source) next() ([]string, bool) {
+	if len(src.peeked) != 0 {
+		rec := src.peeked[0]
+		src.peeked = src.peeked[1:]
+		return rec, true
+	}
+	return src.read()
+}
+
+// read reads the next record from the files, ignoring peeked.
+func (src *source) read() ([]string, bool) {
+	for src.err == nil {
+		rec, err := src.reader.Read()
+		switch {
+		case err == nil && src.opts.noHeader:
+			// Without a header, nextFile can't check that every file has the same columns as the first,
+			// and csv.Reader only checks that the rest of this file matches its first record.
+			if src.width == 0 {
+				src.width = len(rec)
+			} else if len(rec) != src.width {
+				src.err = fmt.Errorf("%s: record has %d fields, want %d", src.file.Name(), len(rec), src.width)
+				return nil, false
+			}
+			return rec, true
+		case err == nil:
+			return rec, true
+		case err != io.EOF:
+			src.err = fmt.Errorf("%s: %w", src.file.Name(), err)
+		case len(src.files) != 0:
+			src.err = src.nextFile()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// peek returns up to the next n records without consuming them.
+func (src *source) peek(n int) ([][]string, error) {
+	for len(src.peeked) < n {
+		rec, ok := src.read()
+		if !ok {
+			break
+		}
+		src.peeked = append(src.peeked, rec)
+	}
+	return src.peeked, src.err
+}
+
+func (src *source) close() {
+	if src.file != nil {
+		src.file.Close()
+		src.file = nil
+	}
+}
+
+// inferSchema returns the schema for a table with the given header and first rows.
+func inferSchema(header []string, sample [][]string) *rawlite.Schema {
+	n := len(header)
+	if header == nil && len(sample) != 0 {
+		n = len(sample[0])
+	}
+
+	schema := &rawlite.Schema{Columns: make([]rawlite.Column, n)}
+	for i := range schema.Columns {
+		col := &schema.Columns[i]
+		if header != nil {
+			col.Name = header[i]
+		} else {
+			col.Name = "c" + strconv.Itoa(i+1)
+		}
+
+		seen, isInt, isReal := false, true, true
+		for _, rec := range sample {
+			s := rec[i]
+			if s == "" {
+				continue
+			}
+			seen = true
+			if !record.IsNumeric([]byte(s)) {
+				isInt, isReal = false, false
+				break
+			}
+			if _, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err != nil {
+				isInt = false
+			}
+		}
+		switch {
+		case seen && isInt:
+			col.Type = "INTEGER"
+		case seen && isReal:
+			col.Type = "REAL"
+		default:
+			col.Type = "TEXT"
+		}
+	}
+	return schema
+}
+
+// encoder converts CSV records to rows of a table.
+type encoder struct {
+	affinities []record.Affinity
+	// rowid is the index of the INTEGER PRIMARY KEY column, or -1.
+	rowid int
+}
+
+func newEncoder(schema *rawlite.Schema) *encoder {
+	enc := &encoder{rowid: -1}
+	for i, col := range schema.Columns {
+		affinity := record.ColumnAffinity(col.Type)
+		if schema.Strict && strings.EqualFold(col.Type, "ANY") {
+			// ANY columns in STRICT tables store values as they are.
+			affinity = record.BlobAffinity
+		}
+		enc.affinities = append(enc.affinities, affinity)
+		if col.PrimaryKey {
+			enc.rowid = i
+		}
+	}
+	return enc
+}
+
+// rows returns the records of src with their rowids.
+// The rowids count up from 1, unless the table has an INTEGER PRIMARY KEY column.
+// If the values of that column aren't increasing integers, rows stops and sets src.err.
+func (enc *encoder) rows(src *source) iter.Seq2[int64, []string] {
+	return func(yield func(int64, []string) bool) {
+		var rowid int64
+		started := false
+		for {
+			rec, ok := src.next()
+			if !ok {
+				return
+			}
+			if enc.rowid >= 0 && enc.rowid < len(rec) {
+				key, err := strconv.ParseInt(strings.TrimSpace(rec[enc.rowid]), 10, 64)
+				if err != nil {
+					src.err = fmt.Errorf("%s: INTEGER PRIMARY KEY %q is not an integer", src.file.Name(), rec[enc.rowid])
+					return
+				}
+				if key <= rowid && started {
+					src.err = fmt.Errorf("%s: INTEGER PRIMARY KEY %d is not greater than %d", src.file.Name(), key, rowid)
+					return
+				}
+				rowid, started = key, true
+			} else {
+				rowid++
+			}
+			if !yield(rowid, rec) {
+				return
+			}
+		}
+	}
+}
+
+func (enc *encoder) encode(rec *record.Record, fields []string) error {
+	if len(fields) != len(enc.affinities) {
+		return fmt.Errorf("row has %d fields, want %d", len(fields), len(enc.affinities))
+	}
+	for i, s := range fields {
+		switch {
+		case i == enc.rowid:
+			rec.AppendNull()
+		case s == "" && enc.affinities[i] != record.TextAffinity:
+			rec.AppendNull()
+		default:
+			rec.AppendStringAs(enc.affinities[i], s)
+		}
+	}
+	return nil
+}
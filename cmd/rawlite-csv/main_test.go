@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/verify"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInferSchema(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header []string
+		sample [][]string
+		want   string
+	}{
+		{"integer", []string{"a"}, [][]string{{"1"}, {" -2 "}, {"+3"}}, "a INTEGER"},
+		{"real", []string{"a"}, [][]string{{"1"}, {"1.5"}}, "a REAL"},
+		{"exponent", []string{"a"}, [][]string{{"1e3"}}, "a REAL"},
+		{"too large for an integer", []string{"a"}, [][]string{{"9223372036854775808"}}, "a REAL"},
+		{"text", []string{"a"}, [][]string{{"1"}, {"1.5"}, {"x"}}, "a TEXT"},
+		{"hex", []string{"a"}, [][]string{{"0x10"}}, "a TEXT"},
+		{"empty fields are skipped", []string{"a", "b"}, [][]string{{"", ""}, {"1", "1.5"}, {"", ""}}, "a INTEGER, b REAL"},
+		{"only empty fields", []string{"a"}, [][]string{{""}, {""}}, "a TEXT"},
+		{"no rows", []string{"a", "b"}, nil, "a TEXT, b TEXT"},
+		{"no header", nil, [][]string{{"1", "x"}}, "c1 INTEGER, c2 TEXT"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var cols []string
+			for _, col := range inferSchema(tc.header, tc.sample).Columns {
+				cols = append(cols, col.Name+" "+col.Type)
+			}
+			if got := strings.Join(cols, ", "); got != tc.want {
+				t.Errorf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGroupFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		files   []string
+		table   string
+		want    []tableFiles
+		wantErr bool
+	}{
+		{"one table per file", []string{"a/x.csv", "b/y.tsv", "z"}, "", []tableFiles{{"x", []string{"a/x.csv"}}, {"y", []string{"b/y.tsv"}}, {"z", []string{"z"}}}, false},
+		{"same name", []string{"a/x.csv", "b/x.csv"}, "", nil, true},
+		{"same name in another case", []string{"x.csv", "X.tsv"}, "", nil, true},
+		{"-table", []string{"a/x.csv", "b/x.csv"}, "t", []tableFiles{{"t", []string{"a/x.csv", "b/x.csv"}}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := groupFiles(tc.files, tc.table)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tc.wantErr)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i].name != tc.want[i].name || strings.Join(got[i].files, " ") != strings.Join(tc.want[i].files, " ") {
+					t.Errorf("table %d: got %v, want %v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// file is the name and contents of a file to import.
+type file struct {
+	name, data string
+}
+
+// TestImport imports files and checks the rows of the tables, or the error.
+func TestImport(t *testing.T) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	rowidSchema := &rawlite.Schema{Columns: []rawlite.Column{
+		{Name: "id", Type: "INTEGER", PrimaryKey: true},
+		{Name: "name", Type: "TEXT"},
+	}}
+	strictSchema := &rawlite.Schema{Columns: []rawlite.Column{
+		{Name: "a", Type: "INTEGER"},
+		{Name: "b", Type: "ANY"},
+	}, Strict: true}
+
+	for _, tc := range []struct {
+		name  string
+		files []file
+		table string
+		opts  options
+		// query is run on the database, or wantErr is part of the error importing the files.
+		query, want string
+		wantErr     string
+	}{
+		{
+			name:  "inferred types",
+			files: []file{{"t.csv", "a,b,c\n1,1.5,x\n2,,\n,3,\"y,z\"\n"}},
+			query: "SELECT rowid, quote(a), quote(b), quote(c) FROM t; SELECT sql FROM sqlite_schema",
+			want:  "1|1|1.5|'x'\n2|2|NULL|''\n3|NULL|3.0|'y,z'\n" + `CREATE TABLE "t" ("a" INTEGER, "b" REAL, "c" TEXT)`,
+		},
+		{
+			name:  "tsv",
+			files: []file{{"t.tsv", "a\tb\n1\tx\"y\n"}},
+			query: "SELECT quote(a), quote(b) FROM t",
+			want:  `1|'x"y'`,
+		},
+		{
+			name:  "separator",
+			files: []file{{"t.txt", "a;b\n1;2\n"}},
+			opts:  options{separator: ";"},
+			query: "SELECT a + b FROM t",
+			want:  "3",
+		},
+		{
+			name:  "several files",
+			files: []file{{"a/t.csv", "a\n1\n2\n"}, {"b/t.csv", "a\n3\n"}},
+			table: "t",
+			query: "SELECT group_concat(a) FROM t",
+			want:  "1,2,3",
+		},
+		{
+			name:    "same table name",
+			files:   []file{{"a/t.csv", "a\n1\n"}, {"b/t.csv", "a\n2\n"}},
+			wantErr: "would both be imported into table t",
+		},
+		{
+			name:    "headers differ",
+			files:   []file{{"a.csv", "a\n1\n"}, {"b.csv", "a,b\n2,3\n"}},
+			table:   "t",
+			wantErr: "b.csv: header has 2 fields, want 1",
+		},
+		{
+			name:  "no header",
+			files: []file{{"a.csv", "1,x\n2,y\n"}, {"b.csv", "3,z\n"}},
+			table: "t",
+			opts:  options{noHeader: true},
+			query: "SELECT sum(c1), group_concat(c2) FROM t",
+			want:  "6|x,y,z",
+		},
+		{
+			name:    "no header, fields differ",
+			files:   []file{{"a.csv", "1,x\n2,y\n"}, {"b.csv", "3,z,w\n"}},
+			table:   "t",
+			opts:    options{noHeader: true},
+			wantErr: "b.csv: record has 3 fields, want 2",
+		},
+		{
+			name:  "schema",
+			files: []file{{"t.csv", "a,b\n1,1.5\n2,x\n"}},
+			opts:  options{schema: strictSchema},
+			query: "SELECT quote(a), quote(b) FROM t; PRAGMA integrity_check",
+			want:  "1|'1.5'\n2|'x'\nok",
+		},
+		{
+			name:    "schema, wrong type",
+			files:   []file{{"t.csv", "a,b\n1,1\nx,2\n"}},
+			opts:    options{schema: strictSchema},
+			wantErr: "TEXT value in INTEGER column",
+		},
+		{
+			name:  "rowids",
+			files: []file{{"t.csv", "id,name\n5,a\n 9 ,b\n100,c\n"}},
+			opts:  options{schema: rowidSchema},
+			query: "SELECT rowid, id, name FROM t",
+			want:  "5|5|a\n9|9|b\n100|100|c",
+		},
+		{
+			name:    "rowids not increasing",
+			files:   []file{{"t.csv", "id,name\n5,a\n5,b\n"}},
+			opts:    options{schema: rowidSchema},
+			wantErr: "INTEGER PRIMARY KEY 5 is not greater than 5",
+		},
+		{
+			name:    "rowid not an integer",
+			files:   []file{{"t.csv", "id,name\n5,a\n1.5,b\n"}},
+			opts:    options{schema: rowidSchema},
+			wantErr: `INTEGER PRIMARY KEY "1.5" is not an integer`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var names []string
+			for _, f := range tc.files {
+				name := filepath.Join(dir, f.name)
+				if err := os.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(name, []byte(f.data), 0o666); err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, name)
+			}
+			opts := tc.opts
+			if opts.inferRows == 0 {
+				opts.inferRows = 1000
+			}
+			opts.workers = 2
+
+			data, err := importCSV(names, tc.table, &opts)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				if len(data) != 0 {
+					t.Errorf("wrote %d bytes after an error", len(data))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := verify.Check(bytes.NewReader(data)); err != nil {
+				t.Errorf("verify.Check: %v", err)
+			}
+
+			name := filepath.Join(dir, "test.db")
+			if err := os.WriteFile(name, data, 0o666); err != nil {
+				t.Fatal(err)
+			}
+			out, err := exec.Command(sqlite3, name, tc.query).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%s: %s %v", tc.query, out, err)
+			}
+			if got := string(bytes.TrimSpace(out)); got != tc.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+// importCSV imports files as run does, and returns the database.
+func importCSV(files []string, table string, opts *options) ([]byte, error) {
+	tables, err := groupFiles(files, table)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	var out bytes.Buffer
+	db := rawlite.OpenDatabaseWriterContext(ctx, &out, rawlite.PageSize(1024))
+	err = importFiles(ctx, cancel, db, tables, opts)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return out.Bytes(), err
+}
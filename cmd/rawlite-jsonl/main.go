@@ -0,0 +1,175 @@
+// Rawlite-jsonl imports newline-delimited JSON files into a new SQLite database.
+//
+// Usage:
+//
+//	rawlite-jsonl [flags] -o out.db file.jsonl...
+//
+// Each file is imported into a table named after the file, without its extension,
+// with one row per JSON object.
+// A file named "-" is read from standard input into a table named "stdin".
+// Two files that would make tables with the same name are an error,
+// reported before anything is written.
+// With -o -, the database is written to standard output once it is complete,
+// for example to pipe it to gzip.
+//
+// Each -c flag adds a column holding the value at a path in each object:
+//
+//	-c name=path
+//	-c name:TYPE=path
+//
+// where path is a list of keys separated by dots, such as user.id.
+// The -rest flag adds a column holding the rest of each object as JSON.
+// Without any -c flags, each object is stored whole in a column named json.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/jsonl"
+)
+
+var (
+	output   = flag.String("o", "", "write the database to `file`, or to standard output if it is -")
+	force    = flag.Bool("f", false, "overwrite the output file if it exists")
+	rest     = flag.String("rest", "", "store the rest of each object as JSON in the column `name`")
+	pageSize = flag.Int("pagesize", 65536, "database page size")
+	workers  = flag.Int("workers", 0, "number of decoding workers (default GOMAXPROCS)")
+)
+
+// columnsFlag collects the -c flags.
+type columnsFlag []jsonl.Column
+
+func (c *columnsFlag) String() string {
+	return ""
+}
+
+func (c *columnsFlag) Set(s string) error {
+	name, path, ok := strings.Cut(s, "=")
+	if !ok || name == "" || path == "" {
+		return fmt.Errorf("%q is not name=path or name:TYPE=path", s)
+	}
+	name, typ, _ := strings.Cut(name, ":")
+	*c = append(*c, jsonl.Column{Name: name, Path: path, Type: typ})
+	return nil
+}
+
+func main() {
+	var columns columnsFlag
+	flag.Var(&columns, "c", "add a column `name[:TYPE]=path`; may be repeated")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -o out.db file.jsonl...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !rawlite.ValidPageSize(*pageSize) {
+		fmt.Fprintf(os.Stderr, "rawlite-jsonl: invalid page size %d\n", *pageSize)
+		os.Exit(2)
+	}
+
+	opts := jsonl.Options{Columns: columns, Rest: *rest, Workers: *workers}
+	if len(opts.Columns) == 0 && opts.Rest == "" {
+		opts.Rest = "json"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "rawlite-jsonl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, opts jsonl.Options) error {
+	tables := make(map[string]string)
+	for _, name := range flag.Args() {
+		// SQLite's table names are case-insensitive.
+		key := strings.ToLower(tableName(name))
+		if other, ok := tables[key]; ok {
+			return fmt.Errorf("%s and %s would both be imported into table %s", other, name, tableName(name))
+		}
+		tables[key] = name
+	}
+
+	// Canceling ctx makes the Database fail,
+	// so that no partial database is written when an import fails.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	db, f, err := createOutput(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range flag.Args() {
+		if err = importFile(ctx, db, name, opts); err != nil {
+			cancel(err)
+			break
+		}
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(*output)
+		}
+	}
+	return err
+}
+
+// createOutput opens the database on the output file, which it returns to be closed after the database,
+// or on standard output if the output file is "-", in which case the file is nil.
+func createOutput(ctx context.Context) (*rawlite.Database, *os.File, error) {
+	if *output == "-" {
+		return rawlite.OpenDatabaseWriterContext(ctx, os.Stdout, rawlite.PageSize(*pageSize)), nil, nil
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*output, flags, 0o666)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rawlite.OpenDatabaseContext(ctx, f, rawlite.PageSize(*pageSize)), f, nil
+}
+
+// tableName returns the name of the table the file name is imported into.
+func tableName(name string) string {
+	if name == "-" {
+		return "stdin"
+	}
+	return strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+}
+
+// importFile imports the file name into a new table named after it.
+func importFile(ctx context.Context, db *rawlite.Database, name string, opts jsonl.Options) error {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	if err := jsonl.Import(ctx, db, tableName(name), r, opts); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
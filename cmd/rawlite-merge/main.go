@@ -0,0 +1,77 @@
+// Rawlite-merge combines SQLite databases with the same tables into a new database.
+//
+// Usage:
+//
+//	rawlite-merge [flags] -o out.db in.db...
+//
+// The rows of each table are renumbered from 1 in the order of the inputs,
+// unless -keep-rowids is given.
+// See the merge package for the databases that can be merged.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/jordanwade90/rawlite/merge"
+	"io"
+	"os"
+	"os/signal"
+)
+
+var (
+	output     = flag.String("o", "", "write the database to `file`")
+	force      = flag.Bool("f", false, "overwrite the output file if it exists")
+	keepRowids = flag.Bool("keep-rowids", false, "keep the rowids of the rows, which must not overlap between inputs")
+	pageSize   = flag.Int("pagesize", 0, "database page size (default the page size of the first input)")
+	workers    = flag.Int("workers", 0, "number of inputs to copy at once (default GOMAXPROCS)")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] -o out.db in.db...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *output == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := run(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "rawlite-merge:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context) error {
+	var srcs []io.ReaderAt
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		srcs = append(srcs, f)
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+	if *force {
+		flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(*output, flags, 0o666)
+	if err != nil {
+		return err
+	}
+
+	err = merge.Merge(ctx, f, srcs, merge.Options{PageSize: *pageSize, KeepRowids: *keepRowids, Workers: *workers})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*output)
+	}
+	return err
+}
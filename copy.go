@@ -0,0 +1,215 @@
+package rawlite
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/jordanwade90/rawlite/internal/btree"
+	"github.com/jordanwade90/rawlite/internal/pagebuf"
+	"io"
+)
+
+// CopyRows writes the rows of a table in another SQLite database to the stream,
+// assigning their rowids as WriteRow does.
+// src is the other database file, and rootPage is the root page of the table,
+// as listed in its sqlite_schema table.
+//
+// Rows are copied without decoding them.
+// If src has the same page size as the Database,
+// the overflow pages of large rows are copied page by page
+// with only the pointers between them changed.
+// Otherwise, and if the Table was opened with ValidateRows,
+// each row is read whole and written as WriteRow would.
+// The cells of the rows are added to the stream's pages with their new rowids,
+// since a different rowid can change the size of a cell;
+// CopyRowsWithID can copy leaf pages whole instead.
+func (s *TableStream) CopyRows(src io.ReaderAt, rootPage uint32) error {
+	return s.copyRows(src, rootPage, false)
+}
+
+// CopyRowsWithID is like CopyRows, but it keeps the rowids of the rows,
+// as WriteRowWithID does.
+// The TableStream must have been opened with OpenStreamRange,
+// and the rowids must be within its range and greater than the rowid of any row written before.
+//
+// If src has the same page size as the Database and the Table wasn't opened with ValidateRows,
+// each leaf page of the table is copied whole,
+// with only the page numbers of the copies of its overflow pages changed,
+// and becomes a leaf page of the Table of its own.
+// Rows written to the stream before are flushed to a leaf page first.
+func (s *TableStream) CopyRowsWithID(src io.ReaderAt, rootPage uint32) error {
+	if s.rangeIndex < 0 {
+		return ErrNoRowidRange
+	}
+	return s.copyRows(src, rootPage, true)
+}
+
+func (s *TableStream) copyRows(src io.ReaderAt, rootPage uint32, keepRowids bool) error {
+	f, err := btree.Open(src)
+	if err != nil {
+		return err
+	}
+	db := s.parent.parent
+	copyOverflow := f.PageSize == db.pageSize && s.parent.schema == nil
+
+	return f.Leaves(rootPage, func(n uint32, page []byte) error {
+		if err := db.check(); err != nil {
+			return err
+		}
+		if copyOverflow && keepRowids && btree.HeaderOffset(n) == 0 {
+			return s.copyLeaf(f, n, page)
+		}
+		for i := range btree.NumCells(n, page) {
+			c, err := f.Cell(n, page, i)
+			if err != nil {
+				return err
+			}
+
+			if copyOverflow {
+				err = s.copyCell(f, c, keepRowids)
+			} else if payload, readErr := f.Payload(c); readErr != nil {
+				err = readErr
+			} else if keepRowids {
+				err = s.WriteRowWithID(c.Rowid, payload)
+			} else {
+				_, err = s.WriteRow(payload)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// copyLeaf copies the leaf page n of f, which has the same page size as the Database,
+// to a stream with a rowid range, keeping its rowids.
+// It changes page, which the caller must not use again.
+// If it fails, the copies of the overflow pages are put on the freelist.
+func (s *TableStream) copyLeaf(f *btree.File, n uint32, page []byte) (err error) {
+	numCells := btree.NumCells(n, page)
+	if numCells == 0 {
+		return nil
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	db := s.parent.parent
+	start := len(s.overflow)
+	defer func() {
+		if err != nil {
+			for _, pageNum := range s.overflow[start:] {
+				db.freePage(pageNum)
+			}
+			s.overflow = s.overflow[:start]
+		}
+	}()
+	rowid := s.nextRowid - 1
+	for i := range numCells {
+		c, err := f.Cell(n, page, i)
+		if err != nil {
+			return err
+		}
+		if c.Rowid <= rowid || c.Rowid > s.lastRowid {
+			return fmt.Errorf("rowid %d: %w", c.Rowid, ErrRowidRange)
+		}
+		rowid = c.Rowid
+		if c.Overflow == 0 {
+			continue
+		}
+		overflowPointer, err := db.copyOverflowPages(f, c, &s.overflow)
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(page[c.End-4:], uint32(overflowPointer))
+	}
+
+	pageNum, err := db.allocPage()
+	if err != nil {
+		return err
+	}
+	s.leaves = append(s.leaves, tableChild{pageNum, rowid})
+	if rowid == s.lastRowid {
+		// The range is used up, as in addCellWithID.
+		s.nextRowid, s.lastRowid = 1, 0
+	} else {
+		s.nextRowid = rowid + 1
+	}
+	return db.writePage(pageNum, page)
+}
+
+// copyCell adds the cell c from f to the stream, copying its overflow pages.
+func (s *TableStream) copyCell(f *btree.File, c btree.Cell, keepRowid bool) error {
+	db := s.parent.parent
+	if s.rangeIndex < 0 {
+		overflowPointer, err := db.copyOverflowPages(f, c, &s.overflow)
+		if err != nil {
+			return err
+		}
+		_, err = s.addCell(c.PayloadLen, c.Local, overflowPointer)
+		s.settleOverflow(err)
+		return err
+	}
+
+	rowid := s.nextRowid
+	if keepRowid {
+		rowid = c.Rowid
+	}
+	if rowid < s.nextRowid || rowid > s.lastRowid {
+		return fmt.Errorf("rowid %d: %w", rowid, ErrRowidRange)
+	}
+	overflowPointer, err := db.copyOverflowPages(f, c, &s.overflow)
+	if err != nil {
+		return err
+	}
+	return s.addCellWithID(rowid, c.PayloadLen, c.Local, overflowPointer)
+}
+
+// copyOverflowPages copies the overflow pages of c from f,
+// which must have the same page size as the Database,
+// appending the page numbers of the copies to *chain,
+// and returns the first of the copies.
+// If it fails, the copies are put on the freelist instead.
+func (db *Database) copyOverflowPages(f *btree.File, c btree.Cell, chain *[]pagebuf.PageNumber) (overflowPointer pagebuf.PageNumber, err error) {
+	if c.Overflow == 0 {
+		return 0, nil
+	}
+
+	start := len(*chain)
+	defer func() {
+		if err != nil {
+			for _, pageNum := range (*chain)[start:] {
+				db.freePage(pageNum)
+			}
+			*chain = (*chain)[:start]
+		}
+	}()
+
+	page := make([]byte, db.pageSize)
+	if overflowPointer, err = db.allocPage(); err != nil {
+		return 0, err
+	}
+	*chain = append(*chain, overflowPointer)
+
+	srcPage := c.Overflow
+	numPages := f.OverflowPages(c)
+	for i := range numPages {
+		if err = f.ReadPage(srcPage, page); err != nil {
+			return 0, err
+		}
+		srcPage = binary.BigEndian.Uint32(page)
+
+		var nextPage pagebuf.PageNumber
+		if i+1 < numPages {
+			if nextPage, err = db.allocPage(); err != nil {
+				return 0, err
+			}
+			*chain = append(*chain, nextPage)
+		}
+		binary.BigEndian.PutUint32(page, uint32(nextPage))
+		if err = db.writePage((*chain)[start+i], page); err != nil {
+			return 0, err
+		}
+	}
+	return overflowPointer, nil
+}
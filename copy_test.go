@@ -0,0 +1,102 @@
+package rawlite_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/internal/btree"
+	"github.com/jordanwade90/rawlite/record"
+	"testing"
+)
+
+// spilledRow returns a row that keeps only the smallest possible part on a 512-byte page,
+// so that many rows with overflow pages share each leaf page.
+func spilledRow(i int) []byte {
+	var rec record.Record
+	rec.AppendString(fmt.Sprintf("%0536d", i))
+	return rec.AppendTo(nil)
+}
+
+// TestCopyRowsWithID checks that the leaf pages CopyRowsWithID copies whole
+// follow the rows written to the stream before them,
+// and that a copy that fails part way leaves no pages behind.
+func TestCopyRowsWithID(t *testing.T) {
+	src := &memFile{}
+	db := rawlite.OpenDatabase(src, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	s, err := tbl.OpenStreamRange(1000, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 1500; i++ {
+		if err := s.WriteRowWithID(int64(i), spilledRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bf, err := btree.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := bf.Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := entries[0].RootPage
+
+	f := &memFile{}
+	db = rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl = db.OpenTable()
+	s, err = tbl.OpenStreamRange(1, 1499)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := s.WriteRowWithID(int64(i), overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.CopyRowsWithID(src, root); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The range of this stream ends in the middle of a leaf page of the source,
+	// after the overflow pages of some of its rows have been copied.
+	tbl = db.OpenTable()
+	short, err := tbl.OpenStreamRange(1000, 1250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := short.CopyRowsWithID(src, root); !errors.Is(err, rawlite.ErrRowidRange) {
+		t.Errorf("copying rowids outside the range: got %v, want ErrRowidRange", err)
+	}
+	if err := short.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("u", "CREATE TABLE u(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	want := querySQLite(t, src, "SELECT count(*) + 100, sum(rowid) + 5050, sum(length(a)) FROM t")
+	if got := querySQLite(t, f, "SELECT count(*), sum(rowid), (SELECT sum(length(a)) FROM t WHERE rowid >= 1000) FROM t"); got != want {
+		t.Errorf("got count, rowid sum, and copied length %s, want %s", got, want)
+	}
+}
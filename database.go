@@ -1,10 +1,15 @@
 package rawlite
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"github.com/jordanwade90/rawlite/internal/pagebuf"
 	"github.com/jordanwade90/rawlite/record"
 	"io"
+	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 )
@@ -18,79 +23,452 @@ type schemaRecord struct {
 }
 
 // Database represents a database file being created.
+//
+// If writing the file fails, or the context passed to OpenDatabaseContext is canceled,
+// the Database fails: every later write returns the same error without writing anything,
+// and Close returns it without writing the database header.
 type Database struct {
 	file           io.WriterAt
+	pageSize       int
 	nextPageNumber *atomic.Uint32
 
-	// schemaLock protects schemaRecords and closed
+	// out is the writer passed to OpenDatabaseWriter, which file is copied to by Close.
+	out io.Writer
+	// spoolDir and spoolLimit are set by the SpoolDir and SpoolLimit options.
+	spoolDir   string
+	spoolLimit int64
+	// writes is set by the CoalesceWrites option.
+	writes *writeBuffer
+
+	// schemaLock protects schemaRecords, closed, and header
 	schemaLock    sync.Mutex
 	schemaRecords []schemaRecord
 	closed        bool
+	header        Header
+
+	// freeLock protects freePages.
+	freeLock  sync.Mutex
+	freePages []pagebuf.PageNumber
+
+	// failed is set once cause is, so that writes can check for failure
+	// without taking failLock.
+	failed atomic.Bool
+	// failLock protects cause.
+	failLock sync.Mutex
+	// cause is the error the Database failed with.
+	cause error
+	// stopContext stops watching the context passed to OpenDatabaseContext.
+	stopContext func()
+}
+
+// Header describes the database header written by Database.Close.
+type Header struct {
+	// PageSize is the size of each page in bytes.
+	PageSize int
+	// PageCount is the size of the database in pages.
+	PageCount uint32
+	// ChangeCounter is the file change counter.
+	ChangeCounter uint32
+	// FreePageCount is the number of pages on the freelist.
+	FreePageCount uint32
+}
+
+// A DatabaseOption configures a Database.
+type DatabaseOption func(*Database)
+
+// PageSize sets the page size of the database,
+// which must be a power of two between 512 and 65536.
+// The default is 65536.
+// If the page size is invalid, the Database fails with an error wrapping ErrInvalidOption;
+// check page sizes that come from users with ValidPageSize to report them sooner.
+//
+// Large pages make for fewer, larger writes and shallower B-trees,
+// but every table and index occupies at least one page.
+func PageSize(pageSize int) DatabaseOption {
+	return func(db *Database) {
+		if !ValidPageSize(pageSize) {
+			db.fail(fmt.Errorf("%w: page size %d", ErrInvalidOption, pageSize))
+			return
+		}
+		db.pageSize = pageSize
+	}
+}
+
+// ValidPageSize reports whether pageSize is a page size SQLite supports:
+// a power of two between 512 and 65536.
+func ValidPageSize(pageSize int) bool {
+	return pageSize >= 512 && pageSize <= 65536 && pageSize&(pageSize-1) == 0
 }
 
 // OpenDatabase prepares to write a SQLite database to file.
-func OpenDatabase(file io.WriterAt) *Database {
+func OpenDatabase(file io.WriterAt, opts ...DatabaseOption) *Database {
 	db := &Database{
 		file:           file,
+		pageSize:       65536,
 		nextPageNumber: &atomic.Uint32{},
 	}
+	for _, opt := range opts {
+		opt(db)
+	}
 	db.nextPageNumber.Store(2)
 	return db
 }
 
+// SpoolDir sets the directory for the temporary file
+// that a Database opened with OpenDatabaseWriter spools its pages to.
+// The default is os.TempDir().
+func SpoolDir(dir string) DatabaseOption {
+	return func(db *Database) {
+		db.spoolDir = dir
+	}
+}
+
+// SpoolLimit limits the temporary file that a Database opened with OpenDatabaseWriter
+// spools its pages to to limit bytes.
+// A write that would make it larger makes the Database fail with an error wrapping ErrSpoolFull.
+// The default, 0, is no limit; a negative limit makes the Database fail
+// with an error wrapping ErrInvalidOption.
+// SpoolLimit has no effect on a Database opened with OpenDatabase.
+func SpoolLimit(limit int64) DatabaseOption {
+	return func(db *Database) {
+		if limit < 0 {
+			db.fail(fmt.Errorf("%w: negative spool limit %d", ErrInvalidOption, limit))
+			return
+		}
+		db.spoolLimit = limit
+	}
+}
+
+// OpenDatabaseWriter prepares to write a SQLite database to w,
+// which unlike the file passed to OpenDatabase doesn't need to support random access,
+// so it can be a pipe or a network connection.
+//
+// Pages are written to a temporary file until Close writes the header
+// and then copies the whole database to w in order.
+// The temporary file needs as much space as the database:
+// nothing can be written to w before Close,
+// since the first page holds the header and the root of the sqlite_schema table,
+// which aren't known until then.
+// Use SpoolLimit to make the Database fail instead of filling the disk.
+// Close removes the temporary file whether or not the Database failed,
+// so a Database opened with OpenDatabaseWriter must always be closed.
+// If the temporary file can't be created, the Database fails.
+func OpenDatabaseWriter(w io.Writer, opts ...DatabaseOption) *Database {
+	db := OpenDatabase(nil, opts...)
+	db.out = w
+	spool, err := os.CreateTemp(db.spoolDir, "rawlite-*.db")
+	if err != nil {
+		db.fail(err)
+	}
+	// NOTE(jw): if CreateTemp failed, spool is a nil *os.File, which is never used.
+	db.file = spool
+	return db
+}
+
+// OpenDatabaseWriterContext is like OpenDatabaseWriter,
+// but if ctx is canceled before Close the Database fails with the context's cause.
+func OpenDatabaseWriterContext(ctx context.Context, w io.Writer, opts ...DatabaseOption) *Database {
+	db := OpenDatabaseWriter(w, opts...)
+	db.watchContext(ctx)
+	return db
+}
+
+// copyOut copies the database from the temporary file to the writer passed to OpenDatabaseWriter,
+// unless err is set, and removes the temporary file.
+// It returns err or the first error doing so.
+func (db *Database) copyOut(err error) error {
+	spool := db.file.(*os.File)
+	if spool == nil {
+		return err
+	}
+	if err == nil {
+		// Pages that were never written, such as the lock-byte page, read as zeroes,
+		// but the file must be long enough to hold the last of them.
+		size := int64(db.header.PageCount) * int64(db.pageSize)
+		if err = db.checkSpool(size); err == nil {
+			err = spool.Truncate(size)
+		}
+		if err == nil {
+			_, err = io.Copy(db.out, io.NewSectionReader(spool, 0, size))
+		}
+		if err != nil {
+			err = db.fail(err)
+		}
+	}
+	if closeErr := spool.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(spool.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// checkSpool returns an error wrapping ErrSpoolFull
+// if the temporary file of a Database opened with OpenDatabaseWriter
+// would be larger than SpoolLimit allows once it is size bytes long.
+func (db *Database) checkSpool(size int64) error {
+	if db.out == nil || db.spoolLimit == 0 || size <= db.spoolLimit {
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes, more than the limit of %d", ErrSpoolFull, size, db.spoolLimit)
+}
+
+// OpenDatabaseContext is like OpenDatabase,
+// but if ctx is canceled before Close the Database fails with the context's cause.
+func OpenDatabaseContext(ctx context.Context, file io.WriterAt, opts ...DatabaseOption) *Database {
+	db := OpenDatabase(file, opts...)
+	db.watchContext(ctx)
+	return db
+}
+
+// watchContext makes the Database fail with the cause of ctx when ctx is canceled.
+func (db *Database) watchContext(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		db.fail(context.Cause(ctx))
+	})
+	db.stopContext = func() {
+		// NOTE(jw): the function passed to AfterFunc runs on its own goroutine,
+		// so it may not have run yet when ctx was canceled just before Close.
+		if !stop() {
+			db.fail(context.Cause(ctx))
+		}
+	}
+}
+
 // Close writes the SQLite file header and the sqlite_schema table
 // pointing to the root nodes of each Table and Index.
+// If the Database has failed, Close returns the error it failed with instead.
 // It does not close the file the database was opened on.
+// A Database opened with OpenDatabaseWriter is then copied to its writer.
 func (db *Database) Close() error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 
 	if db.closed {
-		panic("database closed")
+		return ErrClosed
 	}
 	db.closed = true
 
-	hdr := pagebuf.NewDatabaseHeader(pageSize)
+	if db.stopContext != nil {
+		db.stopContext()
+	}
+	err := db.finish()
+	if db.out != nil {
+		err = db.copyOut(err)
+	}
+	return err
+}
+
+// finish writes the sqlite_schema table, the freelist, and the database header.
+// The caller must hold schemaLock.
+func (db *Database) finish() error {
+	if err := db.check(); err != nil {
+		return err
+	}
+
+	// SQLite reads the schema in rowid order,
+	// so tables must come before the indexes that refer to them.
+	slices.SortStableFunc(db.schemaRecords, func(a, b schemaRecord) int {
+		return cmp.Compare(schemaTypeOrder(a.typ), schemaTypeOrder(b.typ))
+	})
+
+	hdr := pagebuf.NewDatabaseHeader(db.pageSize)
 
 	// Simple case: everything fits in a single leaf node
+	rows := make([][]byte, len(db.schemaRecords))
+	fits := true
 	for i, entry := range db.schemaRecords {
 		row, err := db.writeSchemaRecord(i, entry)
 		if err != nil {
 			return err
 		}
-		if !hdr.Add(row) {
-			panic("not implemented")
+		rows[i] = row
+		fits = fits && hdr.Add(row)
+	}
+
+	var rightMostPointer pagebuf.PageNumber
+	if !fits {
+		var err error
+		if rightMostPointer, err = db.writeSchemaTree(hdr, rows); err != nil {
+			return err
 		}
 	}
 
-	_, err := db.file.WriteAt(hdr.Finish(0), 0)
-	return err
+	freelistTrunk, err := db.writeFreelist()
+	if err != nil {
+		return err
+	}
+
+	// Every Table and Index has been closed and the schema is written,
+	// so no more pages will be allocated.
+	db.header = Header{
+		PageSize:      db.pageSize,
+		PageCount:     db.nextPageNumber.Load() - 1,
+		ChangeCounter: 1,
+		FreePageCount: uint32(len(db.freePages)),
+	}
+	err = db.writePage(1, hdr.Finish(uint32(rightMostPointer), pagebuf.HeaderFields{
+		PageCount:     db.header.PageCount,
+		ChangeCounter: db.header.ChangeCounter,
+		FreelistTrunk: freelistTrunk,
+		FreelistCount: db.header.FreePageCount,
+	}))
+	if err != nil {
+		return err
+	}
+	return db.flush()
+}
+
+// Header returns the values Close wrote to the database header,
+// for example to log them.
+// It returns the zero Header if the Database has not been closed.
+func (db *Database) Header() Header {
+	db.schemaLock.Lock()
+	defer db.schemaLock.Unlock()
+
+	return db.header
+}
+
+// Err returns the error the Database failed with, or nil if it hasn't failed.
+func (db *Database) Err() error {
+	db.failLock.Lock()
+	defer db.failLock.Unlock()
+
+	return db.cause
+}
+
+// fail makes the Database fail with err, unless it has already failed,
+// and returns the error it failed with.
+func (db *Database) fail(err error) error {
+	db.failLock.Lock()
+	defer db.failLock.Unlock()
+
+	if db.cause == nil {
+		db.cause = err
+		db.failed.Store(true)
+	}
+	return db.cause
+}
+
+// check returns the error the Database failed with, or nil if it hasn't failed.
+// It is cheaper than Err when the Database hasn't failed.
+func (db *Database) check() error {
+	if !db.failed.Load() {
+		return nil
+	}
+	return db.Err()
+}
+
+// tableChild is a pointer from an interior node to a child page.
+type tableChild struct {
+	pageNumber pagebuf.PageNumber
+	rowid      int64
+}
+
+// writeSchemaTree writes the sqlite_schema rows to leaf pages
+// and builds interior nodes above them until the remaining children fit on page 1,
+// returning the right-most pointer of the root node.
+func (db *Database) writeSchemaTree(hdr *pagebuf.DatabaseHeader, rows [][]byte) (pagebuf.PageNumber, error) {
+	var children []tableChild
+	leaf := pagebuf.NewTableLeaf(db.pageSize)
+	for i, row := range rows {
+		if leaf.Add(row) {
+			continue
+		}
+		pageNum, err := db.allocPage()
+		if err != nil {
+			return 0, err
+		}
+		if err := db.writePage(pageNum, leaf.Finish()); err != nil {
+			return 0, err
+		}
+		children = append(children, tableChild{pageNum, int64(i)})
+		leaf.Add(row)
+	}
+	pageNum, err := db.allocPage()
+	if err != nil {
+		return 0, err
+	}
+	if err := db.writePage(pageNum, leaf.Finish()); err != nil {
+		return 0, err
+	}
+	children = append(children, tableChild{pageNum, int64(len(rows))})
+
+	interiorPage := make([]byte, db.pageSize)
+	cell := make([]byte, 0, 13)
+	for {
+		hdr.Promote()
+		fits := true
+		for _, child := range children[:len(children)-1] {
+			cell = appendTableInteriorCell(cell[:0], child.pageNumber, child.rowid)
+			if !hdr.Add(cell) {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			return children[len(children)-1].pageNumber, nil
+		}
+
+		// The root doesn't fit on page 1 yet; add another level.
+		var parents []tableChild
+		node := pagebuf.NewTableInterior(db.pageSize)
+		for i, child := range children {
+			if !node.Add(child.pageNumber, child.rowid) || i+1 == len(children) {
+				for {
+					pageNum, err := db.allocPage()
+					if err != nil {
+						return 0, err
+					}
+					rightmostRowid, empty := node.Put(interiorPage)
+					if err := db.writePage(pageNum, interiorPage); err != nil {
+						return 0, err
+					}
+					parents = append(parents, tableChild{pageNum, rightmostRowid})
+					if empty || i+1 < len(children) {
+						break
+					}
+				}
+			}
+		}
+		children = parents
+	}
 }
 
 // OpenTable records schema information for an index
 // and prepares the database for TableStreams to begin work.
-func (db *Database) OpenTable() *Table {
+func (db *Database) OpenTable(opts ...TableOption) *Table {
 	t := &Table{
 		parent:       db,
-		interiorPage: make([]byte, pageSize),
+		interiorPage: make([]byte, db.pageSize),
+	}
+	for _, opt := range opts {
+		opt(t)
 	}
 	return t
 }
 
+// OpenIndex prepares the database for IndexStreams to begin work on an index.
+func (db *Database) OpenIndex() *Index {
+	return &Index{parent: db}
+}
+
 // addSchemaRecord adds a row to the sqlite_schema table.
-func (db *Database) addSchemaRecord(schema schemaRecord) {
+func (db *Database) addSchemaRecord(schema schemaRecord) error {
 	db.schemaLock.Lock()
 	defer db.schemaLock.Unlock()
 
 	if db.closed {
-		panic("database closed")
+		return ErrClosed
 	}
 
 	db.schemaRecords = append(db.schemaRecords, schema)
+	return nil
 }
 
-func (db *Database) addTableSchemaRecord(name, sql string, rootPage pagebuf.PageNumber) {
-	db.addSchemaRecord(schemaRecord{
+func (db *Database) addTableSchemaRecord(name, sql string, rootPage pagebuf.PageNumber) error {
+	return db.addSchemaRecord(schemaRecord{
 		typ:       "table",
 		name:      name,
 		tableName: name,
@@ -99,50 +477,165 @@ func (db *Database) addTableSchemaRecord(name, sql string, rootPage pagebuf.Page
 	})
 }
 
+func schemaTypeOrder(typ string) int {
+	if typ == "index" {
+		return 1
+	}
+	return 0
+}
+
+// freePage records that a page was allocated but will never be used,
+// so that Close can put it on the freelist.
+func (db *Database) freePage(pageNumber pagebuf.PageNumber) {
+	db.freeLock.Lock()
+	defer db.freeLock.Unlock()
+
+	db.freePages = append(db.freePages, pageNumber)
+}
+
+// writeFreelist writes the freelist trunk pages and zeroes the freelist leaf pages,
+// returning the first trunk page.
+func (db *Database) writeFreelist() (pagebuf.PageNumber, error) {
+	db.freeLock.Lock()
+	defer db.freeLock.Unlock()
+
+	slices.Sort(db.freePages)
+
+	// Older versions of SQLite only accept this many leaves per trunk page.
+	maxLeaves := db.pageSize/4 - 8
+	page := make([]byte, db.pageSize)
+	next := pagebuf.PageNumber(0)
+
+	// Write the trunk pages back to front so each one can point to the next.
+	numTrunks := (len(db.freePages) + maxLeaves) / (maxLeaves + 1)
+	for i := numTrunks - 1; i >= 0; i-- {
+		group := db.freePages[i*(maxLeaves+1) : min((i+1)*(maxLeaves+1), len(db.freePages))]
+		trunk, leaves := group[0], group[1:]
+
+		clear(page)
+		for _, leaf := range leaves {
+			// Zero the leaves in case they were never written,
+			// since SQLite expects the file to contain every page.
+			if err := db.writePage(leaf, page); err != nil {
+				return 0, err
+			}
+		}
+
+		binary.BigEndian.PutUint32(page, uint32(next))
+		binary.BigEndian.PutUint32(page[4:], uint32(len(leaves)))
+		for j, leaf := range leaves {
+			binary.BigEndian.PutUint32(page[8+4*j:], uint32(leaf))
+		}
+		if err := db.writePage(trunk, page); err != nil {
+			return 0, err
+		}
+		next = trunk
+	}
+	return next, nil
+}
+
+// maxPageCount is the largest number of pages a SQLite database can have.
+const maxPageCount = 0xffff_fffe
+
 // allocPage allocates a page from the database file.
-func (db *Database) allocPage() pagebuf.PageNumber {
+// If the database is full, it makes the Database fail with ErrDatabaseFull.
+func (db *Database) allocPage() (pagebuf.PageNumber, error) {
 	for {
-		p := db.nextPageNumber.Add(1) - 1
-		if p == 0 {
-			panic("database too large")
+		p := db.nextPageNumber.Load()
+		if p > maxPageCount {
+			return 0, db.fail(ErrDatabaseFull)
+		}
+		// NOTE(jw): the page number must never wrap around,
+		// so unlike Add this can't hand out page numbers past maxPageCount.
+		if !db.nextPageNumber.CompareAndSwap(p, p+1) {
+			continue
 		}
-		if !isLockBytePage(p) {
-			return pagebuf.PageNumber(p)
+		if !db.isLockBytePage(p) {
+			return pagebuf.PageNumber(p), nil
 		}
 	}
 }
 
-func isLockBytePage(pageNumber uint32) bool {
-	return int64(pageNumber-1)*pageSize == 1073741824
+// isLockBytePage returns whether pageNumber is the page containing the lock bytes,
+// which SQLite never uses.
+func (db *Database) isLockBytePage(pageNumber uint32) bool {
+	return int64(pageNumber-1)*int64(db.pageSize) == 1073741824
 }
 
+// maxRowsPerPage is the number of rowids allocated to each leaf page of a Table.
+func (db *Database) maxRowsPerPage() int64 {
+	return int64(db.pageSize / minRowSize)
+}
+
+// writePage writes a page to the database file,
+// making the Database fail if it can't.
+// With CoalesceWrites, the page is buffered instead.
 func (db *Database) writePage(pageNumber pagebuf.PageNumber, page []byte) error {
-	_, err := db.file.WriteAt(page, int64(pageNumber-1)*pageSize)
-	return err
+	if err := db.check(); err != nil {
+		return err
+	}
+	if db.writes != nil {
+		if !db.writes.add(pageNumber, page) {
+			return nil
+		}
+		return db.flush()
+	}
+	return db.writeAt(pageNumber, page)
+}
+
+// writeAt writes pages, starting with pageNumber, to the database file,
+// making the Database fail if it can't.
+func (db *Database) writeAt(pageNumber pagebuf.PageNumber, pages []byte) error {
+	if err := db.checkSpool(int64(pageNumber-1)*int64(db.pageSize) + int64(len(pages))); err != nil {
+		return db.fail(err)
+	}
+	if _, err := db.file.WriteAt(pages, int64(pageNumber-1)*int64(db.pageSize)); err != nil {
+		return db.fail(err)
+	}
+	return nil
 }
 
-func (db *Database) writeOverflowPages(row []byte) (overflowPointer pagebuf.PageNumber, rowOnPage []byte, err error) {
-	spaceRequired := tableLeafPayloadOnPage(pageSize, len(row))
+// writeOverflowPages writes the part of row that does not fit in spaceRequired bytes
+// to a chain of overflow pages, appending their page numbers to *chain.
+// If it fails, the pages of the chain are put on the freelist instead.
+func (db *Database) writeOverflowPages(row []byte, spaceRequired int, chain *[]pagebuf.PageNumber) (overflowPointer pagebuf.PageNumber, rowOnPage []byte, err error) {
 	if len(row) > spaceRequired {
-		page := make([]byte, pageSize)
+		start := len(*chain)
+		defer func() {
+			if err != nil {
+				for _, pageNum := range (*chain)[start:] {
+					db.freePage(pageNum)
+				}
+				*chain = (*chain)[:start]
+			}
+		}()
+
+		page := make([]byte, db.pageSize)
 		overflow := row[spaceRequired:]
 		row = row[:spaceRequired]
-		overflowPointer = db.allocPage()
+		if overflowPointer, err = db.allocPage(); err != nil {
+			return 0, nil, err
+		}
+		*chain = append(*chain, overflowPointer)
 		thisPage := overflowPointer
-		nextPage := pagebuf.PageNumber(0)
 
-		for len(overflow) > pageSize-4 {
-			nextPage = db.allocPage()
+		for len(overflow) > db.pageSize-4 {
+			var nextPage pagebuf.PageNumber
+			if nextPage, err = db.allocPage(); err != nil {
+				return 0, nil, err
+			}
+			*chain = append(*chain, nextPage)
 			binary.BigEndian.PutUint32(page, uint32(nextPage))
 			copy(page[4:], overflow)
-			overflow = overflow[pageSize-4:]
+			overflow = overflow[db.pageSize-4:]
 			if err = db.writePage(thisPage, page); err != nil {
 				return 0, nil, err
 			}
 			thisPage = nextPage
 		}
 
-		binary.BigEndian.PutUint32(page, uint32(nextPage))
+		// The last page of the chain has no next page.
+		binary.BigEndian.PutUint32(page, 0)
 		copy(page[4:], overflow)
 		clear(page[4+len(overflow):])
 		if err = db.writePage(thisPage, page); err != nil {
@@ -162,7 +655,8 @@ func (db *Database) writeSchemaRecord(rowid int, entry schemaRecord) (row []byte
 
 	payload := rec.AppendTo(nil)
 	payloadLen := len(payload)
-	overflowPointer, payload, err := db.writeOverflowPages(payload)
+	var chain []pagebuf.PageNumber
+	overflowPointer, payload, err := db.writeOverflowPages(payload, tableLeafPayloadOnPage(db.pageSize, payloadLen), &chain)
 	if err != nil {
 		return nil, err
 	}
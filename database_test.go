@@ -0,0 +1,250 @@
+package rawlite_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"os"
+	"testing"
+)
+
+// TestCancelBeforeClose checks that a context canceled just before Close always makes Close fail.
+func TestCancelBeforeClose(t *testing.T) {
+	errCanceled := errors.New("canceled")
+	for range 1000 {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		db := rawlite.OpenDatabaseContext(ctx, &memFile{})
+		cancel(errCanceled)
+		if err := db.Close(); err != errCanceled {
+			t.Fatalf("Close: got %v, want %v", err, errCanceled)
+		}
+	}
+}
+
+// TestMultiPageSchema checks sqlite_schema tables that need more than one page,
+// because of many tables or long CREATE TABLE statements.
+func TestMultiPageSchema(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		tables, width int
+	}{
+		{"many tables", 1000, 1},
+		{"long sql", 3, 2000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &memFile{}
+			db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+			for i := range tc.tables {
+				var schema rawlite.Schema
+				for j := range tc.width {
+					schema.Columns = append(schema.Columns, rawlite.Column{Name: fmt.Sprintf("column_%d", j), Type: "TEXT"})
+				}
+				tbl := db.OpenTable()
+				s := tbl.OpenStream()
+				var rec record.Record
+				for range tc.width {
+					rec.AppendString("x")
+				}
+				if _, err := s.WriteRow(rec.AppendTo(nil)); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+				name := fmt.Sprintf("t%d", i)
+				sql, err := schema.CreateTableSQL(name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := tbl.Close(name, sql); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkDatabase(t, f)
+			if f.data[100] != 5 {
+				t.Fatal("sqlite_schema fits on page 1")
+			}
+
+			if got, want := querySQLite(t, f, "SELECT count(*) FROM sqlite_schema"), fmt.Sprint(tc.tables); got != want {
+				t.Errorf("sqlite_schema has %s rows, want %s", got, want)
+			}
+			last := fmt.Sprintf("t%d", tc.tables-1)
+			if got := querySQLite(t, f, "SELECT count(*) FROM "+last); got != "1" {
+				t.Errorf("%s has %s rows, want 1", last, got)
+			}
+		})
+	}
+}
+
+// TestPageSizes checks a database written with each page size SQLite supports.
+func TestPageSizes(t *testing.T) {
+	for pageSize := 512; pageSize <= 65536; pageSize *= 2 {
+		t.Run(fmt.Sprint(pageSize), func(t *testing.T) {
+			f := &memFile{}
+			db := rawlite.OpenDatabase(f, rawlite.PageSize(pageSize))
+			tbl := db.OpenTable()
+			s := tbl.OpenStream()
+			for i := range 2000 {
+				if _, err := s.WriteRow(overflowRow(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkDatabase(t, f)
+
+			if got, want := querySQLite(t, f, "PRAGMA page_size"), fmt.Sprint(pageSize); got != want {
+				t.Errorf("page_size: got %s, want %s", got, want)
+			}
+			if got := querySQLite(t, f, "SELECT count(*) FROM t"); got != "2000" {
+				t.Errorf("t has %s rows, want 2000", got)
+			}
+		})
+	}
+	for _, pageSize := range []int{0, 256, 1000, 131072} {
+		if rawlite.ValidPageSize(pageSize) {
+			t.Errorf("ValidPageSize(%d) = true", pageSize)
+		}
+	}
+}
+
+// TestHeaderFields checks the database size, change counter, and version fields Close writes.
+func TestHeaderFields(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(1024))
+	tbl := db.OpenTable()
+	s := tbl.OpenStream()
+	for i := range 1000 {
+		if _, err := s.WriteRow(overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	hdr := db.Header()
+	field := func(offset int) uint32 { return binary.BigEndian.Uint32(f.data[offset:]) }
+	if got, want := field(28), uint32(len(f.data)/1024); got != want || got != hdr.PageCount {
+		t.Errorf("page count: got %d, want %d and Header().PageCount %d", got, want, hdr.PageCount)
+	}
+	if got := field(24); got != hdr.ChangeCounter || got == 0 {
+		t.Errorf("change counter: got %d, want Header().ChangeCounter %d", got, hdr.ChangeCounter)
+	}
+	if got, want := field(92), field(24); got != want {
+		t.Errorf("version-valid-for number: got %d, want the change counter %d", got, want)
+	}
+	if got, want := field(96), uint32(3003000); got != want {
+		t.Errorf("SQLite version number: got %d, want %d", got, want)
+	}
+
+	if got, want := querySQLite(t, f, "PRAGMA page_count"), fmt.Sprint(hdr.PageCount); got != want {
+		t.Errorf("page_count: got %s, want %s", got, want)
+	}
+}
+
+// TestInvalidOptions checks that invalid options make the Database fail rather than panic.
+func TestInvalidOptions(t *testing.T) {
+	for name, opt := range map[string]rawlite.DatabaseOption{
+		"page size 1000":     rawlite.PageSize(1000),
+		"page size 256":      rawlite.PageSize(256),
+		"negative threshold": rawlite.CoalesceWrites(-1),
+	} {
+		db := rawlite.OpenDatabase(&memFile{}, opt)
+		if err := db.Close(); !errors.Is(err, rawlite.ErrInvalidOption) {
+			t.Errorf("%s: got %v, want ErrInvalidOption", name, err)
+		}
+	}
+
+	db := rawlite.OpenDatabase(&memFile{})
+	db.OpenTable(rawlite.ValidateRows(rawlite.Schema{Strict: true, Columns: []rawlite.Column{{Name: "a", Type: "VARCHAR"}}}))
+	if err := db.Err(); err == nil {
+		t.Error("ValidateRows with an invalid schema: no error")
+	}
+}
+
+// writeTable writes a table of overflowing rows to db.
+func writeTable(db *rawlite.Database, rows int) error {
+	tbl := db.OpenTable()
+	s := tbl.OpenStream()
+	for i := range rows {
+		if _, err := s.WriteRow(overflowRow(i)); err != nil {
+			return err
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return tbl.Close("t", "CREATE TABLE t(a, b)")
+}
+
+// TestDatabaseWriter checks that OpenDatabaseWriter writes the same bytes as OpenDatabase
+// and removes its temporary file.
+func TestDatabaseWriter(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(1024))
+	if err := writeTable(db, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	dir := t.TempDir()
+	var out bytes.Buffer
+	db = rawlite.OpenDatabaseWriter(&out, rawlite.PageSize(1024), rawlite.SpoolDir(dir), rawlite.SpoolLimit(int64(len(f.data))))
+	if err := writeTable(db, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), f.data) {
+		t.Errorf("OpenDatabaseWriter wrote %d bytes that differ from the %d written by OpenDatabase", out.Len(), len(f.data))
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("spool directory after Close: %v, %v", entries, err)
+	}
+}
+
+// TestSpoolLimit checks that a Database whose temporary file would pass SpoolLimit fails
+// without writing anything.
+func TestSpoolLimit(t *testing.T) {
+	dir := t.TempDir()
+	var out bytes.Buffer
+	db := rawlite.OpenDatabaseWriter(&out, rawlite.PageSize(1024), rawlite.SpoolDir(dir), rawlite.SpoolLimit(100*1024))
+	if err := writeTable(db, 2000); !errors.Is(err, rawlite.ErrSpoolFull) {
+		t.Errorf("got %v, want ErrSpoolFull", err)
+	}
+	if err := db.Close(); !errors.Is(err, rawlite.ErrSpoolFull) {
+		t.Errorf("Close: got %v, want ErrSpoolFull", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("wrote %d bytes, want none", out.Len())
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("spool directory after Close: %v, %v", entries, err)
+	}
+}
@@ -23,7 +23,17 @@
 // each operating independently,
 // arranging the data in such a way that these independent streams may be merged at the end.
 // Closing a Table creates the interior nodes of the B-tree.
-// Closing a Database creates the `sqlite_schema` table pointing to the root nodes of each table.
+// An IndexStream does the same for index B-trees,
+// but because an index is ordered by its keys rather than by rowids the library assigns,
+// each IndexStream must be given a disjoint range of keys
+// in the order the IndexStreams were opened.
+// WITHOUT ROWID tables are stored as index B-trees,
+// so a WithoutRowidTable is written with IndexStreams too.
+// Closing a Database creates the `sqlite_schema` table pointing to the root nodes of each table and index.
+// Pages are written at random offsets, with page 1 last,
+// so a Database opened with OpenDatabaseWriter spools them to a temporary file
+// and copies the finished database in order to a writer that doesn't support random access;
+// SpoolLimit bounds the size of the temporary file.
 //
 // Page allocation, B-tree interior nodes, and overflow pages for large cells are abstracted,
 // but it is still required to format cells correctly
@@ -31,4 +41,55 @@
 // independently-generated streams of leaf nodes into a valid B-tree.
 // The library guarantees this for TableStream by internally generating rowids
 // for each cell in such a way that guarantees a valid B-tree can be formed.
+// Alternatively, a TableStream opened with OpenStreamRange accepts rowids chosen by the caller
+// from a range reserved for that stream.
+// Ingest runs a pool of workers that each write to their own TableStream,
+// which is enough for tables whose rows don't need particular rowids;
+// IngestOrdered does the same with OpenStreamRange to keep the rows in input order.
+// TableStream.CopyRows copies the rows of a table in another database without decoding them,
+// which the merge package uses to combine databases written separately.
+// A ShardedDatabase spreads the rows of its tables over several Databases by their keys,
+// describing the partitioning in a manifest.
+// A RollingDatabase instead moves on to a new Database whenever the current one reaches a maximum size,
+// keeping the rowids of each table unique across them.
+// For IndexStream it is the caller's responsibility to write records in the index's sort order.
+//
+// Rows are formatted with the record package.
+// A record.Encoder formats rows from the fields of a struct
+// and generates the matching CREATE TABLE statement, so the two can't disagree.
+// Alternatively, a Schema generates the CREATE TABLE statement,
+// and the ValidateRows option checks every row written to a Table against it.
+//
+// The first error writing a Database makes it fail,
+// so that every stream stops writing and Database.Close reports that error.
+// To stop the workers when something outside the library fails,
+// open the Database with OpenDatabaseContext and cancel the context,
+// or pass the context to WriteRowContext.
+//
+// # Errors
+//
+// Errors fall into two groups:
+//
+//   - Errors that make the Database fail:
+//     an error from the underlying file, the cause of a canceled context,
+//     ErrDatabaseFull when the database would exceed SQLite's maximum page count,
+//     which a RollingDatabase avoids, ErrSpoolFull from a Database opened with OpenDatabaseWriter,
+//     and errors from mistakes in the calling code that are only noticed once writing has begun:
+//     ErrInvalidOption for an option such as an invalid page size or a negative CoalesceWrites threshold,
+//     the error Schema.Check reports for a schema passed to ValidateRows,
+//     and ErrMixedRowids from Table.OpenStream on a Table with rowid ranges.
+//     Once the Database has failed, every write and Close return the same error,
+//     which Database.Err also reports.
+//   - Errors about a single row or call, which leave the Database usable:
+//     a *RowError (possibly wrapping ErrStrictType) from a Table opened with ValidateRows,
+//     ErrRowidRange and ErrNoRowidRange from WriteRowWithID,
+//     ErrRowidRange and ErrMixedRowids from OpenStreamRange,
+//     and ErrClosed when using a Database, Table, or Index after closing it.
+//     Ingest and its variants skip a row with such an error, or an error from encoding it,
+//     and return the errors of the skipped rows together once the Table is closed.
+//
+// Check page sizes and schemas that come from users
+// with ValidPageSize and Schema.Check to report them before opening anything;
+// Schema.Check returns ErrSchemaTooLarge for a table with more columns than SQLite allows.
+// The library only panics for its own bugs.
 package rawlite
@@ -0,0 +1,37 @@
+package rawlite
+
+import (
+	"errors"
+)
+
+var (
+	// ErrClosed is returned when using a Database, Table, or Index after it has been closed,
+	// including when closing it a second time.
+	ErrClosed = errors.New("already closed")
+	// ErrDatabaseFull is returned when a Database would need more pages
+	// than a SQLite database can have.
+	// The Database fails with it, so every later write returns it too.
+	ErrDatabaseFull = errors.New("database is full")
+	// ErrRowidRange is returned by WriteRowWithID for a rowid that is outside the stream's range
+	// or not greater than the previous rowid,
+	// and by OpenStreamRange for a range that is empty or overlaps another stream's.
+	ErrRowidRange = errors.New("rowid out of order or outside range")
+	// ErrNoRowidRange is returned by WriteRowWithID on a TableStream
+	// that wasn't opened with OpenStreamRange.
+	ErrNoRowidRange = errors.New("stream has no rowid range")
+	// ErrMixedRowids is returned when opening a TableStream whose rowids are chosen
+	// differently from those of the Table's other streams:
+	// by OpenStreamRange on a Table with DenseRowids or with streams opened with OpenStream,
+	// and by OpenStream on a Table with streams opened with OpenStreamRange.
+	ErrMixedRowids = errors.New("streams with automatic rowids and rowid ranges on one table")
+	// ErrInvalidOption is what a Database or RollingDatabase fails with
+	// when given an option with an invalid value, such as a page size that isn't a power of two.
+	ErrInvalidOption = errors.New("invalid option")
+	// ErrSpoolFull is what a Database opened with OpenDatabaseWriter fails with
+	// when its temporary file would grow past the SpoolLimit.
+	ErrSpoolFull = errors.New("spool file limit exceeded")
+	// ErrSchemaTooLarge is returned by Schema.Check for a table
+	// with more columns than SQLite allows by default,
+	// which SQLite would refuse to open.
+	ErrSchemaTooLarge = errors.New("schema too large")
+)
@@ -0,0 +1,155 @@
+package rawlite_test
+
+import (
+	"errors"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"strings"
+	"testing"
+)
+
+// overflowRow returns a row that needs overflow pages on small pages for some values of i.
+func overflowRow(i int) []byte {
+	var rec record.Record
+	rec.AppendInt(int64(i))
+	rec.AppendString(strings.Repeat("x", i%700))
+	return rec.AppendTo(nil)
+}
+
+// TestAbandonedRangeOverflow checks that the leaves of a range stream closed after its Table,
+// and the overflow pages of their cells, go on the freelist.
+func TestAbandonedRangeOverflow(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	kept, err := tbl.OpenStreamRange(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		if err := kept.WriteRowWithID(int64(i), overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kept.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := tbl.OpenStreamRange(1000, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1000; i < 4000; i++ {
+		if err := s.WriteRowWithID(int64(i), overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); !errors.Is(err, rawlite.ErrClosed) {
+		t.Fatalf("closing the stream after the table: got %v, want ErrClosed", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header().FreePageCount == 0 {
+		t.Error("no pages on the freelist")
+	}
+	checkDatabase(t, f)
+}
+
+// TestAbandonedAutoRowidOverflow checks that the overflow pages of a row
+// written to a stream after its Table is closed go on the freelist.
+func TestAbandonedAutoRowidOverflow(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	s := tbl.OpenStream()
+	if _, err := s.WriteRow(overflowRow(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteRow(overflowRow(699)); !errors.Is(err, rawlite.ErrClosed) {
+		t.Fatalf("writing after closing the table: got %v, want ErrClosed", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+}
+
+// TestAbandonedIndexOverflow checks that the leaves of an IndexStream closed after its Index,
+// and the overflow pages of its cells, go on the freelist.
+func TestAbandonedIndexOverflow(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	ts := tbl.OpenStream()
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := db.OpenIndex()
+	s := idx.OpenStream()
+	for i := 0; i < 3000; i++ {
+		var rec record.Record
+		rec.AppendInt(int64(i))
+		rec.AppendString(strings.Repeat("x", i%700))
+		rec.AppendInt(int64(i + 1))
+		if err := s.WriteRecord(rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Close("i", "t", "CREATE INDEX i ON t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); !errors.Is(err, rawlite.ErrClosed) {
+		t.Fatalf("closing the stream after the index: got %v, want ErrClosed", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+}
+
+// TestAbandonedDenseOverflow checks that the overflow pages of rows still buffered
+// by a stream of a table with DenseRowids when the table is closed go on the freelist.
+func TestAbandonedDenseOverflow(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable(rawlite.DenseRowids())
+	kept, s := tbl.OpenStream(), tbl.OpenStream()
+	for i := range 100 {
+		if _, err := kept.WriteRow(overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.WriteRow(overflowRow(i + 600)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := kept.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); !errors.Is(err, rawlite.ErrClosed) {
+		t.Fatalf("closing the stream after the table: got %v, want ErrClosed", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db.Header().FreePageCount == 0 {
+		t.Error("no pages on the freelist")
+	}
+	checkDatabase(t, f)
+}
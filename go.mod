@@ -3,5 +3,3 @@ module github.com/jordanwade90/rawlite
 go 1.23.0
 
 toolchain go1.23.1
-
-require golang.org/x/exp v0.0.0-20240909161429-701f63a606c0
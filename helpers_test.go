@@ -0,0 +1,86 @@
+package rawlite_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jordanwade90/rawlite/verify"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// memFile is an in-memory database file.
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+// errWrite is the error returned by failingFile.
+var errWrite = errors.New("write failed")
+
+// failingFile is a database file that can't be written to.
+type failingFile struct{}
+
+func (failingFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errWrite
+}
+
+// checkDatabase checks the database in f with verify.Check,
+// and with SQLite's PRAGMA integrity_check if the sqlite3 command is installed.
+func checkDatabase(t *testing.T, f *memFile) {
+	t.Helper()
+	if err := verify.Check(f); err != nil {
+		t.Errorf("verify.Check: %v", err)
+	}
+
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return
+	}
+	name := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(name, f.data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sqlite3, name, "PRAGMA integrity_check").CombinedOutput()
+	if err != nil || string(bytes.TrimSpace(out)) != "ok" {
+		t.Errorf("PRAGMA integrity_check: %s %v", out, err)
+	}
+}
+
+// querySQLite runs sql on the database in f with the sqlite3 command and returns its output,
+// skipping the rest of the test if sqlite3 isn't installed.
+func querySQLite(t *testing.T, f *memFile, sql string) string {
+	t.Helper()
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	name := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(name, f.data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sqlite3, name, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s %v", sql, out, err)
+	}
+	return string(bytes.TrimSpace(out))
+}
@@ -0,0 +1,468 @@
+package rawlite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/jordanwade90/rawlite/internal/pagebuf"
+	"github.com/jordanwade90/rawlite/internal/svarint"
+	"sync"
+)
+
+// Index represents an index being created.
+//
+// Unlike a Table, the order of an index is determined by its keys,
+// so the Index cannot assign positions to the IndexStreams writing it.
+// Instead, the streams are ordered by when they were opened:
+// every record written to an IndexStream must sort after
+// every record written to the IndexStreams opened before it.
+// A typical arrangement is to split the keys into disjoint ranges
+// and open one IndexStream per range, in order, before starting the workers.
+type Index struct {
+	parent *Database
+
+	// runsLock protects runs and closed.
+	runsLock sync.Mutex
+	runs     [][]indexEntry
+	closed   bool
+}
+
+// indexEntry is either a leaf page written by an IndexStream
+// or a cell left for Index.Close to place in the B-tree.
+type indexEntry struct {
+	pageNumber pagebuf.PageNumber
+	cell       []byte
+}
+
+// OpenStream opens an IndexStream for writing to this index.
+// Records written to the stream must sort after records written to
+// all previously opened IndexStreams.
+// If the Index is closed, closing the stream returns ErrClosed.
+func (idx *Index) OpenStream() *IndexStream {
+	idx.runsLock.Lock()
+	defer idx.runsLock.Unlock()
+
+	// NOTE(jw): a stream opened on a closed Index gets a run past the end of runs,
+	// which finishRun never uses because it checks for closed first.
+	run := len(idx.runs)
+	if !idx.closed {
+		idx.runs = append(idx.runs, nil)
+	}
+	return &IndexStream{
+		parent: idx,
+		run:    run,
+		page:   pagebuf.NewIndexLeaf(idx.parent.pageSize),
+		cell:   make([]byte, 0, idx.parent.pageSize),
+	}
+}
+
+// Close closes the B-tree and informs the Database of the root page number.
+// All IndexStreams must be closed before calling Close.
+//
+// tableName is the name of the table the index refers to
+// and sql is the CREATE INDEX statement.
+func (idx *Index) Close(name, tableName, sql string) error {
+	rootPage, err := idx.closeTree()
+	if err != nil {
+		return err
+	}
+
+	return idx.parent.addSchemaRecord(schemaRecord{
+		typ:       "index",
+		name:      name,
+		tableName: tableName,
+		rootPage:  rootPage,
+		sql:       sql,
+	})
+}
+
+// closeTree stitches together the entries written by every IndexStream
+// and builds the interior nodes above them, returning the root page number.
+func (idx *Index) closeTree() (pagebuf.PageNumber, error) {
+	idx.runsLock.Lock()
+	defer idx.runsLock.Unlock()
+
+	if idx.closed {
+		return 0, ErrClosed
+	}
+	idx.closed = true
+
+	if err := idx.parent.check(); err != nil {
+		return 0, err
+	}
+
+	b := &indexBuilder{
+		parent:       idx.parent,
+		leaf:         pagebuf.NewIndexLeaf(idx.parent.pageSize),
+		interiorPage: make([]byte, idx.parent.pageSize),
+	}
+	for _, run := range idx.runs {
+		for _, entry := range run {
+			var err error
+			if entry.pageNumber != 0 {
+				err = b.addLeaf(entry.pageNumber)
+			} else {
+				err = b.addCell(entry.cell)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return b.finish()
+}
+
+func (idx *Index) finishRun(run int, entries []indexEntry, overflow []pagebuf.PageNumber) error {
+	idx.runsLock.Lock()
+	defer idx.runsLock.Unlock()
+
+	if idx.closed {
+		// The leaves, and the overflow pages of their cells, will never be part of the B-tree.
+		for _, entry := range entries {
+			if entry.pageNumber != 0 {
+				idx.parent.freePage(entry.pageNumber)
+			}
+		}
+		for _, pageNum := range overflow {
+			idx.parent.freePage(pageNum)
+		}
+		return ErrClosed
+	}
+
+	idx.runs[run] = entries
+	return nil
+}
+
+// indexBuilder assembles the entries of an Index into a B-tree.
+//
+// Every key in an index B-tree appears exactly once,
+// so the cell between two leaf pages must be taken out of the leaves
+// and moved into their parent.
+// IndexStreams withhold their first and last two cells
+// so that indexBuilder always has enough cells to do this
+// where the output of two streams meet.
+type indexBuilder struct {
+	parent *Database
+
+	// leaf collects cells that don't belong to a leaf page written by an IndexStream.
+	leaf *pagebuf.IndexLeaf
+	// lastCell and lastCheckpoint allow removing the most recent cell from leaf
+	// to use it to separate leaf from the page after it.
+	lastCell       []byte
+	lastCheckpoint [2]int
+	// overflowCell is a cell that didn't fit on leaf, if overflowed is set.
+	// Which cell separates the full leaf from the next page
+	// depends on whether that page is written by an IndexStream.
+	overflowCell []byte
+	overflowed   bool
+	// leftPage is a leaf page that has yet to be followed by a separator.
+	leftPage pagebuf.PageNumber
+
+	interiorNodes []*pagebuf.IndexInterior
+	interiorPage  []byte
+}
+
+func (b *indexBuilder) addCell(cell []byte) error {
+	if b.leftPage != 0 {
+		err := b.addChild(b.leftPage, cell)
+		b.leftPage = 0
+		return err
+	}
+
+	if err := b.splitLeaf(); err != nil {
+		return err
+	}
+	checkpoint := b.leaf.Checkpoint()
+	if !b.leaf.Add(cell) {
+		b.overflowCell = append(b.overflowCell[:0], cell...)
+		b.overflowed = true
+		return nil
+	}
+	b.lastCheckpoint = checkpoint
+	b.lastCell = append(b.lastCell[:0], cell...)
+	return nil
+}
+
+// splitLeaf moves the most recent cell up to separate the full leaf from a new one
+// starting with the cell that didn't fit, if there is one.
+func (b *indexBuilder) splitLeaf() error {
+	if !b.overflowed {
+		return nil
+	}
+	b.overflowed = false
+
+	// Any two cells fit on a page, so the full leaf can't end up empty.
+	b.leaf.Restore(b.lastCheckpoint)
+	if err := b.writeLeaf(b.lastCell); err != nil {
+		return err
+	}
+	b.lastCheckpoint = b.leaf.Checkpoint()
+	b.leaf.Add(b.overflowCell)
+	b.lastCell, b.overflowCell = b.overflowCell, b.lastCell
+	return nil
+}
+
+func (b *indexBuilder) addLeaf(pageNumber pagebuf.PageNumber) error {
+	if b.leftPage != 0 {
+		// NOTE(jw): an IndexStream always writes a separator after each leaf page.
+		panic("internal bug")
+	}
+
+	if b.overflowed {
+		// The cell that didn't fit separates the full leaf from the page,
+		// so the leaf keeps all of its cells.
+		b.overflowed = false
+		if err := b.writeLeaf(b.overflowCell); err != nil {
+			return err
+		}
+	} else if !b.leaf.IsEmpty() {
+		b.leaf.Restore(b.lastCheckpoint)
+		if b.leaf.IsEmpty() {
+			// NOTE(jw): an IndexStream always writes two cells before its first page,
+			// and both are on leaf unless it filled up, so this can't happen.
+			panic("internal bug")
+		}
+		if err := b.writeLeaf(b.lastCell); err != nil {
+			return err
+		}
+	}
+	b.leftPage = pageNumber
+	return nil
+}
+
+// writeLeaf writes the cells collected in leaf to a new page,
+// followed in the B-tree by key.
+func (b *indexBuilder) writeLeaf(key []byte) error {
+	pageNum, err := b.parent.allocPage()
+	if err != nil {
+		return err
+	}
+	if err := b.parent.writePage(pageNum, b.leaf.Finish()); err != nil {
+		return err
+	}
+	return b.addChild(pageNum, key)
+}
+
+func (b *indexBuilder) addChild(pageNum pagebuf.PageNumber, key []byte) error {
+	for i := 0; i < len(b.interiorNodes); i++ {
+		if b.interiorNodes[i].Add(pageNum, key) {
+			return nil
+		}
+
+		var err error
+		if pageNum, err = b.parent.allocPage(); err != nil {
+			return err
+		}
+		key, _ = b.interiorNodes[i].Put(b.interiorPage)
+		if err := b.parent.writePage(pageNum, b.interiorPage); err != nil {
+			return err
+		}
+	}
+
+	b.interiorNodes = append(b.interiorNodes, pagebuf.NewIndexInterior(b.parent.pageSize))
+	b.interiorNodes[len(b.interiorNodes)-1].Add(pageNum, key)
+	return nil
+}
+
+func (b *indexBuilder) finish() (pagebuf.PageNumber, error) {
+	if err := b.splitLeaf(); err != nil {
+		return 0, err
+	}
+	switch {
+	case !b.leaf.IsEmpty():
+		if err := b.writeLeaf(nil); err != nil {
+			return 0, err
+		}
+	case b.leftPage != 0:
+		if err := b.addChild(b.leftPage, nil); err != nil {
+			return 0, err
+		}
+	case len(b.interiorNodes) != 0:
+		// NOTE(jw): the last entry written by an IndexStream is always a cell.
+		panic("internal bug")
+	}
+
+	for i := 0; i < len(b.interiorNodes); i++ {
+		node := b.interiorNodes[i]
+		if node.Length() == 1 {
+			rootPage, _ := node.Remove()
+			return rootPage, nil
+		}
+
+		for {
+			pageNum, err := b.parent.allocPage()
+			if err != nil {
+				return 0, err
+			}
+			key, empty := node.Put(b.interiorPage)
+			if err := b.parent.writePage(pageNum, b.interiorPage); err != nil {
+				return 0, err
+			}
+
+			if i+1 == len(b.interiorNodes) {
+				if empty {
+					// We just wrote the root page.
+					return pageNum, nil
+				}
+
+				b.interiorNodes = append(b.interiorNodes, pagebuf.NewIndexInterior(b.parent.pageSize))
+			}
+			b.interiorNodes[i+1].Add(pageNum, key)
+
+			if empty {
+				break
+			}
+		}
+	}
+
+	// If there were no interior nodes the index must be empty.
+	rootPage, err := b.parent.allocPage()
+	if err != nil {
+		return 0, err
+	}
+	return rootPage, b.parent.writePage(rootPage, b.leaf.Finish())
+}
+
+// IndexStream represents one stream of records being written to an Index.
+// IndexStreams are not thread-safe; open one IndexStream per worker goroutine.
+type IndexStream struct {
+	parent *Index
+	// run is the position of this stream in parent.runs
+	run int
+	// page helps write leaf pages
+	page *pagebuf.IndexLeaf
+	// cell is a reusable buffer for formatting cells
+	cell []byte
+	// entries records the leaf pages written and the cells between them.
+	entries []indexEntry
+	// pending holds the two most recent cells,
+	// which are not written until Close.
+	pending [][]byte
+	// numRecords is the number of records written to the stream.
+	numRecords int
+	// overflow records the overflow pages of the cells written to the stream,
+	// which must be freed along with its leaves if the Index is closed first.
+	overflow []pagebuf.PageNumber
+	// closed is set once Close has handed the stream's entries to the Index.
+	closed bool
+}
+
+// Close writes any buffered pages
+// and informs the parent Index that this IndexStream is finished writing,
+// passing it any bookkeeping information required to construct the B-tree.
+// Closing a stream again does nothing.
+func (s *IndexStream) Close() error {
+	if s.closed {
+		return nil
+	}
+	if !s.page.IsEmpty() {
+		pageNum, err := s.parent.parent.allocPage()
+		if err != nil {
+			return err
+		}
+		if err := s.parent.parent.writePage(pageNum, s.page.Finish()); err != nil {
+			return err
+		}
+		s.entries = append(s.entries, indexEntry{pageNumber: pageNum})
+	}
+	for _, cell := range s.pending {
+		s.entries = append(s.entries, indexEntry{cell: cell})
+	}
+
+	s.closed = true
+	err := s.parent.finishRun(s.run, s.entries, s.overflow)
+	s.entries, s.pending, s.overflow = nil, nil, nil
+	return err
+}
+
+// WriteRecord writes one entry to the index whose contents are rec.
+// For an Index, rec is a record containing the indexed columns followed by the rowid;
+// for a WithoutRowidTable it is the row, starting with the primary key columns.
+// Records must be written in the index's sort order.
+// It returns any error resulting from writing pages to the database.
+//
+// WriteRecord does not retain rec.
+func (s *IndexStream) WriteRecord(rec []byte) error {
+	if err := s.parent.parent.check(); err != nil {
+		return err
+	}
+
+	payloadLen := len(rec)
+	overflowPointer, rec, err := s.parent.parent.writeOverflowPages(rec, indexPayloadOnPage(s.parent.parent.pageSize, payloadLen), &s.overflow)
+	if err != nil {
+		return err
+	}
+	s.cell = appendIndexCell(s.cell[:0], int64(payloadLen), rec, overflowPointer)
+
+	// The first two cells are left for Index.Close
+	// so that it can separate the previous stream's last leaf page from ours.
+	if s.numRecords < 2 {
+		s.numRecords++
+		s.entries = append(s.entries, indexEntry{cell: bytes.Clone(s.cell)})
+		return nil
+	}
+	s.numRecords++
+
+	// Likewise, the last two cells are held back
+	// so that Index.Close can separate our last leaf page from the next stream's.
+	if len(s.pending) < 2 {
+		s.pending = append(s.pending, bytes.Clone(s.cell))
+		return nil
+	}
+	if err := s.add(s.pending[0]); err != nil {
+		return err
+	}
+	s.pending[0], s.pending[1] = s.pending[1], append(s.pending[0][:0], s.cell...)
+	return nil
+}
+
+// WriteRecordContext is like WriteRecord,
+// but if ctx is done it makes the Database fail with the context's cause instead.
+func (s *IndexStream) WriteRecordContext(ctx context.Context, rec []byte) error {
+	if ctx.Err() != nil {
+		return s.parent.parent.fail(context.Cause(ctx))
+	}
+	return s.WriteRecord(rec)
+}
+
+func (s *IndexStream) add(cell []byte) error {
+	if s.page.Add(cell) {
+		return nil
+	}
+
+	// The page is full, so cell moves up to separate it from the next page.
+	pageNum, err := s.parent.parent.allocPage()
+	if err != nil {
+		return err
+	}
+	if err := s.parent.parent.writePage(pageNum, s.page.Finish()); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, indexEntry{pageNumber: pageNum}, indexEntry{cell: bytes.Clone(cell)})
+	return nil
+}
+
+func appendIndexCell(buf []byte, payloadLen int64, payload []byte, overflowPointer pagebuf.PageNumber) []byte {
+	buf = svarint.Append(buf, uint64(payloadLen))
+	buf = append(buf, payload...)
+	if overflowPointer != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(overflowPointer))
+	}
+	return buf
+}
+
+func indexPayloadOnPage(pageSize int, payloadSize int) int {
+	// See the "alternative description" of the payload overflow calculation
+	// from https://sqlite.org/fileformat2.html
+	X := ((pageSize - 12) * 64 / 255) - 23
+	M := ((pageSize - 12) * 32 / 255) - 23
+	K := M + ((payloadSize - M) % (pageSize - 4))
+	switch {
+	case payloadSize <= X:
+		return payloadSize
+	case K <= X:
+		return K
+	default:
+		return M
+	}
+}
@@ -0,0 +1,143 @@
+package rawlite_test
+
+import (
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// indexRow returns the values of row i of the table the index tests write,
+// whose text sometimes needs overflow pages on small pages.
+func indexRow(rec *record.Record, i int) {
+	rec.AppendInt(int64(i))
+	rec.AppendString(strings.Repeat("x", i*7%300))
+}
+
+// writeIndexed writes a table t with a row per record in sizes,
+// and an index on it written by one IndexStream per element of sizes,
+// each getting that many records.
+func writeIndexed(t *testing.T, f *memFile, pageSize int, sizes []int) {
+	t.Helper()
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(pageSize))
+	n := 0
+	for _, size := range sizes {
+		n += size
+	}
+
+	tbl := db.OpenTable()
+	ts, err := tbl.OpenStreamRange(1, int64(max(n, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range n {
+		var rec record.Record
+		indexRow(&rec, i)
+		if err := ts.WriteRowWithID(int64(i+1), rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := db.OpenIndex()
+	var streams []*rawlite.IndexStream
+	for range sizes {
+		streams = append(streams, idx.OpenStream())
+	}
+	i := 0
+	for k, size := range sizes {
+		for range size {
+			var rec record.Record
+			indexRow(&rec, i)
+			rec.AppendInt(int64(i + 1))
+			if err := streams[k].WriteRecord(rec.AppendTo(nil)); err != nil {
+				t.Fatal(err)
+			}
+			i++
+		}
+	}
+	for _, s := range streams {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := idx.Close("i", "t", "CREATE INDEX i ON t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIndexStreams checks indexes written by various numbers of IndexStreams of various sizes.
+func TestIndexStreams(t *testing.T) {
+	for _, pageSize := range []int{512, 1024, 4096} {
+		for _, count := range []int{1, 2, 10} {
+			for _, size := range []int{0, 1, 2, 3, 5, 6, 40, 1000} {
+				for _, last := range []int{0, 3, 6, 100} {
+					sizes := append(slices.Repeat([]int{size}, count), last)
+					t.Run(fmt.Sprintf("pagesize=%d/streams=%dx%d+%d", pageSize, count, size, last), func(t *testing.T) {
+						f := &memFile{}
+						writeIndexed(t, f, pageSize, sizes)
+						checkDatabase(t, f)
+					})
+				}
+			}
+		}
+	}
+}
+
+// TestCloseIndexStreamTwice checks that closing an IndexStream a second time keeps its records.
+func TestCloseIndexStreamTwice(t *testing.T) {
+	const n = 500
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	ts, err := tbl.OpenStreamRange(1, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx := db.OpenIndex()
+	streams := []*rawlite.IndexStream{idx.OpenStream(), idx.OpenStream()}
+	for i := range n {
+		var rec record.Record
+		indexRow(&rec, i)
+		if err := ts.WriteRowWithID(int64(i+1), rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+		rec.AppendInt(int64(i + 1))
+		if err := streams[i*len(streams)/n].WriteRecord(rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range streams {
+		for range 2 {
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := idx.Close("i", "t", "CREATE INDEX i ON t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+	if got := querySQLite(t, f, "SELECT count(*) FROM t INDEXED BY i WHERE a >= 0"); got != fmt.Sprint(n) {
+		t.Errorf("got %s records in the index, want %d", got, n)
+	}
+}
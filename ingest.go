@@ -0,0 +1,269 @@
+package rawlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite/record"
+	"iter"
+	"runtime"
+	"sync"
+)
+
+// Ingest writes one row to tbl for each value of input, using workers goroutines,
+// and then closes tbl with the given name and sql.
+// If workers is less than 1, Ingest uses runtime.GOMAXPROCS(0) workers.
+//
+// Each worker writes to its own TableStream opened with OpenStream,
+// so rows are assigned rowids automatically and aren't stored in the order of input.
+// encode formats the row for a value by appending its columns to rec,
+// which is empty on every call; a record.Encoder's Append method does this for structs.
+// input is consumed on the calling goroutine, and encode is called on the workers.
+//
+// An error from encode, or from writing a row that leaves the Database usable,
+// such as a *RowError from a Table opened with ValidateRows, skips that row;
+// tbl is still closed with the other rows, and Ingest returns the row errors joined with errors.Join,
+// keeping only the first 100 of them.
+// If the Database fails instead, or ctx is done,
+// Ingest stops consuming input and returns the error the Database failed with
+// once the workers have stopped.
+// Database.Err tells the two cases apart.
+func Ingest[T any](ctx context.Context, tbl *Table, name, sql string, input iter.Seq[T], workers int, encode func(rec *record.Record, v T) error) error {
+	ch := make(chan T, ingestWorkers(workers))
+	done := make(chan error, 1)
+	go func() {
+		done <- IngestChan(ctx, tbl, name, sql, ch, workers, encode)
+	}()
+
+loop:
+	for v := range input {
+		if tbl.parent.check() != nil {
+			break
+		}
+		select {
+		case ch <- v:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(ch)
+	return <-done
+}
+
+// IngestChan is like Ingest, but it reads values from a channel until it is closed.
+//
+// If ingestion fails, the workers keep receiving values from input and discard them,
+// so a sender that doesn't watch ctx or Database.Err never blocks forever.
+func IngestChan[T any](ctx context.Context, tbl *Table, name, sql string, input <-chan T, workers int, encode func(rec *record.Record, v T) error) error {
+	return runIngest(ctx, tbl, name, sql, workers, func(errs *ingestErrors) {
+		ingestWorker(ctx, tbl, input, encode, errs)
+	})
+}
+
+// IngestOrdered is like Ingest, but input yields a sequence number with each value,
+// which becomes the rowid of its row, so the rows are stored in the order of input.
+// Sequence numbers must increase, but may skip values;
+// a value whose sequence number doesn't increase is skipped with a row error wrapping ErrRowidRange.
+//
+// IngestOrdered divides input into chunks of consecutive values
+// and writes each chunk to its own TableStream opened with OpenStreamRange,
+// so the last leaf page of each chunk may be only partly full.
+func IngestOrdered[T any](ctx context.Context, tbl *Table, name, sql string, input iter.Seq2[int64, T], workers int, encode func(rec *record.Record, v T) error) error {
+	ch := make(chan *ingestChunk[T], ingestWorkers(workers))
+	var errs ingestErrors
+	done := make(chan error, 1)
+	go func() {
+		done <- runIngestErrors(ctx, tbl, name, sql, workers, &errs, func(errs *ingestErrors) {
+			ingestChunkWorker(ctx, tbl, ch, encode, errs)
+		})
+	}()
+
+	chunk := &ingestChunk[T]{}
+	send := func() bool {
+		select {
+		case ch <- chunk:
+			chunk = &ingestChunk[T]{}
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	started := false
+	var prev int64
+	for seq, v := range input {
+		if tbl.parent.check() != nil {
+			break
+		}
+		if started && seq <= prev {
+			errs.add(fmt.Errorf("sequence number %d after %d: %w", seq, prev, ErrRowidRange))
+			continue
+		}
+		started, prev = true, seq
+
+		chunk.rowids = append(chunk.rowids, seq)
+		chunk.values = append(chunk.values, v)
+		if len(chunk.values) == ingestChunkSize && !send() {
+			break
+		}
+	}
+	if len(chunk.values) != 0 && tbl.parent.check() == nil {
+		send()
+	}
+	close(ch)
+	return <-done
+}
+
+// ingestChunkSize is the number of rows in each chunk written by IngestOrdered.
+const ingestChunkSize = 16384
+
+// ingestChunk is a chunk of values for IngestOrdered and their rowids.
+type ingestChunk[T any] struct {
+	rowids []int64
+	values []T
+}
+
+// runIngest runs work on workers goroutines,
+// then closes tbl and returns the error the Database failed with, if any,
+// or else the errors of the rows that were skipped.
+func runIngest(ctx context.Context, tbl *Table, name, sql string, workers int, work func(errs *ingestErrors)) error {
+	return runIngestErrors(ctx, tbl, name, sql, workers, &ingestErrors{}, work)
+}
+
+// runIngestErrors is like runIngest, but collects row errors in errs,
+// so that errors found before the workers can be reported too.
+func runIngestErrors(ctx context.Context, tbl *Table, name, sql string, workers int, errs *ingestErrors, work func(errs *ingestErrors)) error {
+	var wg sync.WaitGroup
+	for range ingestWorkers(workers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			work(errs)
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		tbl.parent.fail(context.Cause(ctx))
+	}
+	err := tbl.Close(name, sql)
+	if cause := tbl.parent.Err(); cause != nil {
+		return cause
+	}
+	return errs.join(err)
+}
+
+// maxIngestErrors is the number of row errors an ingestion keeps.
+const maxIngestErrors = 100
+
+// ingestErrors collects the errors of the rows an ingestion skipped.
+type ingestErrors struct {
+	// lock protects errs and dropped.
+	lock sync.Mutex
+	errs []error
+	// dropped is the number of errors after the first maxIngestErrors, which aren't kept.
+	dropped int
+}
+
+func (e *ingestErrors) add(err error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if len(e.errs) == maxIngestErrors {
+		e.dropped++
+		return
+	}
+	e.errs = append(e.errs, err)
+}
+
+// join returns err and the row errors joined with errors.Join,
+// or nil if there were none.
+func (e *ingestErrors) join(err error) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	errs := append([]error{err}, e.errs...)
+	if e.dropped != 0 {
+		errs = append(errs, fmt.Errorf("%d more rows skipped", e.dropped))
+	}
+	return errors.Join(errs...)
+}
+
+// rowError handles an error writing a row:
+// if the Database failed, it returns true to stop writing,
+// and otherwise it adds err to errs so the row is skipped.
+func rowError(tbl *Table, errs *ingestErrors, err error) (failed bool) {
+	if tbl.parent.check() != nil {
+		return true
+	}
+	errs.add(err)
+	return false
+}
+
+// ingestWorker writes the values it receives from input to a new TableStream of tbl
+// until input is closed, adding the errors of rows it skips to errs.
+func ingestWorker[T any](ctx context.Context, tbl *Table, input <-chan T, encode func(rec *record.Record, v T) error, errs *ingestErrors) {
+	s := tbl.OpenStream()
+	var rec record.Record
+	var row []byte
+	failed := false
+	for v := range input {
+		if failed {
+			continue
+		}
+
+		rec.Reset()
+		if err := encode(&rec, v); err != nil {
+			errs.add(err)
+			continue
+		}
+		row = rec.AppendTo(row[:0])
+		if _, err := s.WriteRowContext(ctx, row); err != nil {
+			failed = rowError(tbl, errs, err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		tbl.parent.fail(err)
+	}
+}
+
+// ingestChunkWorker writes each chunk it receives from input to a new TableStream of tbl
+// with the chunk's range of rowids, until input is closed,
+// adding the errors of rows it skips to errs.
+func ingestChunkWorker[T any](ctx context.Context, tbl *Table, input <-chan *ingestChunk[T], encode func(rec *record.Record, v T) error, errs *ingestErrors) {
+	var rec record.Record
+	var row []byte
+	for chunk := range input {
+		if tbl.parent.check() != nil {
+			continue
+		}
+
+		rowids := chunk.rowids
+		s, err := tbl.OpenStreamRange(rowids[0], rowids[len(rowids)-1])
+		if err != nil {
+			tbl.parent.fail(err)
+			continue
+		}
+		for i, v := range chunk.values {
+			rec.Reset()
+			if err := encode(&rec, v); err != nil {
+				errs.add(err)
+				continue
+			}
+			row = rec.AppendTo(row[:0])
+			if err := s.WriteRowWithIDContext(ctx, rowids[i], row); err != nil && rowError(tbl, errs, err) {
+				break
+			}
+		}
+		if err := s.Close(); err != nil {
+			tbl.parent.fail(err)
+		}
+	}
+}
+
+// ingestWorkers returns the number of workers to use when asked for workers.
+func ingestWorkers(workers int) int {
+	if workers < 1 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return workers
+}
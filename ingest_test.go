@@ -0,0 +1,223 @@
+package rawlite_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestIngestRowErrors checks that rows that fail to encode or validate are skipped and reported
+// without making the Database fail.
+func TestIngestRowErrors(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	schema := rawlite.Schema{Columns: []rawlite.Column{{Name: "a", Type: "INTEGER"}}, Strict: true}
+	encode := func(rec *record.Record, v int) error {
+		switch v % 100 {
+		case 7:
+			return fmt.Errorf("bad value %d", v)
+		case 8:
+			rec.AppendString("x")
+		default:
+			rec.AppendInt(int64(v))
+		}
+		return nil
+	}
+
+	var values []int
+	for i := range 1000 {
+		values = append(values, i)
+	}
+	sql, err := schema.CreateTableSQL("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rawlite.Ingest(context.Background(), db.OpenTable(rawlite.ValidateRows(schema)), "t", sql, slices.Values(values), 2, encode)
+	if err == nil {
+		t.Fatal("Ingest: no error for bad rows")
+	}
+	if errs := err.(interface{ Unwrap() []error }).Unwrap(); len(errs) != 20 {
+		t.Errorf("Ingest: got %d errors, want 20", len(errs))
+	}
+	var rowErr *rawlite.RowError
+	if !errors.As(err, &rowErr) {
+		t.Errorf("Ingest: %v doesn't include a *RowError", err)
+	}
+	if err := db.Err(); err != nil {
+		t.Fatalf("Database failed: %v", err)
+	}
+
+	ordered := func(yield func(int64, int) bool) {
+		for _, i := range []int64{1, 2, 3, 3, 2, 5, 107} {
+			if !yield(i, int(i)) {
+				return
+			}
+		}
+	}
+	err = rawlite.IngestOrdered(context.Background(), db.OpenTable(), "u", "CREATE TABLE u(a)", ordered, 2, encode)
+	if !errors.Is(err, rawlite.ErrRowidRange) {
+		t.Errorf("IngestOrdered: got %v, want ErrRowidRange", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+}
+
+// TestIngestManyRowErrors checks that Ingest keeps only the first row errors.
+func TestIngestManyRowErrors(t *testing.T) {
+	db := rawlite.OpenDatabase(&memFile{})
+	values := make([]int, 1000)
+	err := rawlite.Ingest(context.Background(), db.OpenTable(), "t", "CREATE TABLE t(a)", slices.Values(values), 2, func(rec *record.Record, v int) error {
+		return errors.New("bad value")
+	})
+	if errs := err.(interface{ Unwrap() []error }).Unwrap(); len(errs) != 101 || errs[100].Error() != "900 more rows skipped" {
+		t.Errorf("Ingest: got %d errors ending with %v, want 101", len(errs), errs[len(errs)-1])
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIngestChan checks that IngestChan writes every value it receives, with several workers.
+func TestIngestChan(t *testing.T) {
+	const n = 20000
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(1024))
+	encode := func(rec *record.Record, v int) error {
+		rec.AppendInt(int64(v))
+		rec.AppendString(fmt.Sprint("v", v))
+		return nil
+	}
+
+	ch := make(chan int)
+	go func() {
+		for i := range n {
+			ch <- i
+		}
+		close(ch)
+	}()
+	if err := rawlite.IngestChan(context.Background(), db.OpenTable(), "t", "CREATE TABLE t(a INTEGER, b TEXT)", ch, 4, encode); err != nil {
+		t.Fatalf("IngestChan: %v", err)
+	}
+
+	// A channel that is closed before any values are sent makes an empty table.
+	empty := make(chan int)
+	close(empty)
+	if err := rawlite.IngestChan(context.Background(), db.OpenTable(), "u", "CREATE TABLE u(a INTEGER, b TEXT)", empty, 4, encode); err != nil {
+		t.Fatalf("IngestChan with no values: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	want := fmt.Sprintf("%d|%d|%d|%d|0", n, n*(n-1)/2, n, n)
+	if got := querySQLite(t, f, "SELECT count(*), sum(a), count(DISTINCT a), sum(b = 'v' || a), (SELECT count(*) FROM u) FROM t"); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// TestIngestChanCancel checks that IngestChan returns the cause of a canceled context,
+// and keeps receiving values so that the sender doesn't block.
+func TestIngestChanCancel(t *testing.T) {
+	errCanceled := errors.New("canceled")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	db := rawlite.OpenDatabase(&memFile{})
+	encode := func(rec *record.Record, v int) error {
+		if v == 1000 {
+			cancel(errCanceled)
+		}
+		rec.AppendInt(int64(v))
+		return nil
+	}
+
+	ch := make(chan int)
+	sent := make(chan struct{})
+	go func() {
+		// The sender doesn't watch ctx.
+		for i := range 100000 {
+			ch <- i
+		}
+		close(ch)
+		close(sent)
+	}()
+	if err := rawlite.IngestChan(ctx, db.OpenTable(), "t", "CREATE TABLE t(a)", ch, 4, encode); err != errCanceled {
+		t.Errorf("IngestChan: got %v, want %v", err, errCanceled)
+	}
+	<-sent
+	if err := db.Err(); err != errCanceled {
+		t.Errorf("Err: got %v, want %v", err, errCanceled)
+	}
+	if err := db.Close(); err != errCanceled {
+		t.Errorf("Close: got %v, want %v", err, errCanceled)
+	}
+}
+
+// TestIngestOrdered checks that IngestOrdered stores rows in the order of input,
+// with sparse sequence numbers spanning many chunks and several workers,
+// and skips a value whose sequence number doesn't increase.
+func TestIngestOrdered(t *testing.T) {
+	const n = 50000
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(1024))
+	encode := func(rec *record.Record, v int) error {
+		rec.AppendInt(int64(v))
+		// Rows of different sizes make the workers finish their chunks out of order.
+		rec.AppendString(strings.Repeat("x", v%200))
+		return nil
+	}
+
+	input := func(yield func(int64, int) bool) {
+		for i := range n {
+			if !yield(int64(3*i+1), i) {
+				return
+			}
+		}
+	}
+	if err := rawlite.IngestOrdered(context.Background(), db.OpenTable(), "t", "CREATE TABLE t(a INTEGER, b TEXT)", input, 4, encode); err != nil {
+		t.Fatalf("IngestOrdered: %v", err)
+	}
+
+	// The value after the sequence number goes back is skipped, but the rest are stored.
+	outOfOrder := func(yield func(int64, int) bool) {
+		for i := range n {
+			seq := int64(2*i + 1)
+			if i == 20000 {
+				seq = 5
+			}
+			if !yield(seq, i) {
+				return
+			}
+		}
+	}
+	err := rawlite.IngestOrdered(context.Background(), db.OpenTable(), "u", "CREATE TABLE u(a INTEGER, b TEXT)", outOfOrder, 4, encode)
+	if !errors.Is(err, rawlite.ErrRowidRange) {
+		t.Errorf("IngestOrdered out of order: got %v, want ErrRowidRange", err)
+	}
+	if err := db.Err(); err != nil {
+		t.Fatalf("Database failed: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	// Each row's a is one more than the previous row's in rowid order.
+	const query = `SELECT count(*), sum(rowid = 3*a + 1), sum(length(b) = a %% 200),
+	(SELECT count(*) FROM (SELECT a - lag(a) OVER (ORDER BY rowid) AS d FROM %[1]s) WHERE d != 1)
+	FROM %[1]s`
+	if got, want := querySQLite(t, f, fmt.Sprintf(query, "t")), fmt.Sprintf("%d|%d|%d|0", n, n, n); got != want {
+		t.Errorf("table t: got %s, want %s", got, want)
+	}
+	want := fmt.Sprintf("%d|0", n-1)
+	if got := querySQLite(t, f, "SELECT count(*), (SELECT count(*) FROM u WHERE a = 20000 OR rowid != 2*a + 1) FROM u"); got != want {
+		t.Errorf("table u: got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,340 @@
+// Package btree reads the table B-trees of existing SQLite database files.
+package btree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite/internal/pagebuf"
+	"github.com/jordanwade90/rawlite/internal/svarint"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+)
+
+// ErrMalformed is wrapped by the errors for files that aren't valid SQLite databases.
+var ErrMalformed = errors.New("malformed database")
+
+// maxDepth is the depth of the deepest B-tree SQLite can read.
+const maxDepth = 20
+
+// Page types.
+const (
+	TableInterior = 5
+	TableLeaf     = 13
+)
+
+// File is a SQLite database file being read.
+type File struct {
+	r        io.ReaderAt
+	PageSize int
+}
+
+// Open reads the header of the SQLite database in r.
+// Databases with reserved space at the end of each page are not supported.
+func Open(r io.ReaderAt) (*File, error) {
+	hdr := make([]byte, pagebuf.DatabaseHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err == io.EOF {
+		return nil, fmt.Errorf("%w: file too short", ErrMalformed)
+	} else if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:16], []byte("SQLite format 3\x00")) {
+		return nil, fmt.Errorf("%w: not a SQLite database", ErrMalformed)
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(hdr[16:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("%w: invalid page size %d", ErrMalformed, pageSize)
+	}
+	if hdr[20] != 0 {
+		return nil, errors.New("databases with reserved space in each page are not supported")
+	}
+	return &File{r: r, PageSize: pageSize}, nil
+}
+
+// ReadPage reads page n into page, which must be PageSize bytes long.
+func (f *File) ReadPage(n uint32, page []byte) error {
+	return f.read(n, 0, page)
+}
+
+// read reads len(buf) bytes from offset off in page n.
+func (f *File) read(n uint32, off int, buf []byte) error {
+	if n == 0 {
+		return fmt.Errorf("%w: page number 0", ErrMalformed)
+	}
+	_, err := f.r.ReadAt(buf, int64(n-1)*int64(f.PageSize)+int64(off))
+	if err == io.EOF {
+		return fmt.Errorf("%w: page %d is past the end of the file", ErrMalformed, n)
+	}
+	return err
+}
+
+// HeaderOffset returns the offset of the B-tree page header in page n,
+// which follows the database header on page 1.
+func HeaderOffset(n uint32) int {
+	if n == 1 {
+		return pagebuf.DatabaseHeaderSize
+	}
+	return 0
+}
+
+// PageType returns the type of B-tree page n.
+func (f *File) PageType(n uint32) (byte, error) {
+	var typ [1]byte
+	err := f.read(n, HeaderOffset(n), typ[:])
+	return typ[0], err
+}
+
+// Leaves calls fn with each leaf page of the table B-tree whose root is root, in rowid order.
+// fn must not retain page.
+func (f *File) Leaves(root uint32, fn func(n uint32, page []byte) error) error {
+	return f.walk(root, nil, false, fn)
+}
+
+// Count returns the number of rows in the table B-tree whose root is root.
+// It only reads the headers of the leaf pages.
+func (f *File) Count(root uint32) (rows int64, err error) {
+	err = f.walk(root, nil, true, func(n uint32, hdr []byte) error {
+		rows += int64(binary.BigEndian.Uint16(hdr[3:]))
+		return nil
+	})
+	return rows, err
+}
+
+// RowidRange returns the smallest and largest rowids in the non-empty table B-tree whose root is root.
+// It only reads the pages on the paths to the first and last leaf pages.
+func (f *File) RowidRange(root uint32) (first, last int64, err error) {
+	if first, err = f.edgeRowid(root, false); err != nil {
+		return 0, 0, err
+	}
+	last, err = f.edgeRowid(root, true)
+	return first, last, err
+}
+
+// edgeRowid returns the largest rowid in the B-tree under page n if rightmost is set,
+// or else the smallest.
+func (f *File) edgeRowid(n uint32, rightmost bool) (int64, error) {
+	page := make([]byte, f.PageSize)
+	for range maxDepth {
+		if err := f.ReadPage(n, page); err != nil {
+			return 0, err
+		}
+		h := HeaderOffset(n)
+		numCells := NumCells(n, page)
+		switch page[h] {
+		case TableLeaf:
+			if numCells == 0 {
+				return 0, fmt.Errorf("%w: page %d is empty", ErrMalformed, n)
+			}
+			i := 0
+			if rightmost {
+				i = numCells - 1
+			}
+			c, err := f.Cell(n, page, i)
+			return c.Rowid, err
+		case TableInterior:
+			if rightmost || numCells == 0 {
+				n = binary.BigEndian.Uint32(page[h+8:])
+				continue
+			}
+			ptr := int(binary.BigEndian.Uint16(page[h+pagebuf.TableInteriorHeaderSize:]))
+			if ptr+4 > len(page) {
+				return 0, fmt.Errorf("%w: page %d has a cell past the end", ErrMalformed, n)
+			}
+			n = binary.BigEndian.Uint32(page[ptr:])
+		default:
+			return 0, fmt.Errorf("%w: page %d is not a table B-tree page", ErrMalformed, n)
+		}
+	}
+	return 0, fmt.Errorf("%w: B-tree is too deep at page %d", ErrMalformed, n)
+}
+
+// walk calls fn with each leaf page of the B-tree under page n.
+// path holds the pages above n, to detect loops.
+// If headers is set, fn is only passed the page header of each leaf page.
+func (f *File) walk(n uint32, path []uint32, headers bool, fn func(n uint32, page []byte) error) error {
+	if len(path) == maxDepth {
+		return fmt.Errorf("%w: B-tree is too deep at page %d", ErrMalformed, n)
+	}
+	for _, p := range path {
+		if p == n {
+			return fmt.Errorf("%w: B-tree contains a loop at page %d", ErrMalformed, n)
+		}
+	}
+
+	h := HeaderOffset(n)
+	if headers {
+		hdr := make([]byte, pagebuf.TableLeafHeaderSize)
+		if err := f.read(n, h, hdr); err != nil {
+			return err
+		}
+		if hdr[0] == TableLeaf {
+			return fn(n, hdr)
+		}
+	}
+
+	page := make([]byte, f.PageSize)
+	if err := f.ReadPage(n, page); err != nil {
+		return err
+	}
+	switch page[h] {
+	case TableLeaf:
+		return fn(n, page)
+	case TableInterior:
+	default:
+		return fmt.Errorf("%w: page %d is not a table B-tree page", ErrMalformed, n)
+	}
+
+	path = append(path, n)
+	numCells := int(binary.BigEndian.Uint16(page[h+3:]))
+	if h+pagebuf.TableInteriorHeaderSize+2*numCells > len(page) {
+		return fmt.Errorf("%w: page %d has too many cells", ErrMalformed, n)
+	}
+	for i := 0; i < numCells; i++ {
+		ptr := int(binary.BigEndian.Uint16(page[h+pagebuf.TableInteriorHeaderSize+2*i:]))
+		if ptr+4 > len(page) {
+			return fmt.Errorf("%w: page %d has a cell past the end", ErrMalformed, n)
+		}
+		if err := f.walk(binary.BigEndian.Uint32(page[ptr:]), path, headers, fn); err != nil {
+			return err
+		}
+	}
+	return f.walk(binary.BigEndian.Uint32(page[h+8:]), path, headers, fn)
+}
+
+// Cell is a cell of a table leaf page.
+type Cell struct {
+	PayloadLen int
+	Rowid      int64
+	// Local is the part of the payload stored on the page.
+	Local []byte
+	// Overflow is the first page of the rest of the payload, or 0 if it is all local.
+	Overflow uint32
+	// End is the offset of the end of the cell in its page,
+	// so the page number of Overflow is the 4 bytes before it.
+	End int
+}
+
+// NumCells returns the number of cells on the leaf page n.
+func NumCells(n uint32, page []byte) int {
+	return int(binary.BigEndian.Uint16(page[HeaderOffset(n)+3:]))
+}
+
+// Cell returns cell i of the leaf page n.
+// The cell refers to page.
+func (f *File) Cell(n uint32, page []byte, i int) (Cell, error) {
+	h := HeaderOffset(n)
+	if h+pagebuf.TableLeafHeaderSize+2*i+2 > len(page) {
+		return Cell{}, fmt.Errorf("%w: page %d has too many cells", ErrMalformed, n)
+	}
+	ptr := int(binary.BigEndian.Uint16(page[h+pagebuf.TableLeafHeaderSize+2*i:]))
+	if ptr >= len(page) {
+		return Cell{}, fmt.Errorf("%w: page %d has a cell past the end", ErrMalformed, n)
+	}
+
+	p := page[ptr:]
+	payloadLen, m := svarint.Get(p)
+	rowid, k := svarint.Get(p[m:])
+	if m == 0 || k == 0 || payloadLen > 0x7fff_ffff {
+		return Cell{}, fmt.Errorf("%w: page %d has an invalid cell", ErrMalformed, n)
+	}
+	p = p[m+k:]
+
+	c := Cell{PayloadLen: int(payloadLen), Rowid: int64(rowid)}
+	local := LocalPayload(f.PageSize, c.PayloadLen)
+	end := local
+	if local < c.PayloadLen {
+		end += 4
+	}
+	if end > len(p) {
+		return Cell{}, fmt.Errorf("%w: page %d has a cell past the end", ErrMalformed, n)
+	}
+	c.Local = p[:local]
+	c.End = ptr + m + k + end
+	if local < c.PayloadLen {
+		c.Overflow = binary.BigEndian.Uint32(p[local:])
+	}
+	return c, nil
+}
+
+// LocalPayload returns how much of a payload of payloadLen bytes
+// is stored on a table leaf page of pageSize bytes.
+func LocalPayload(pageSize, payloadLen int) int {
+	// See the "alternative description" of the payload overflow calculation
+	// from https://sqlite.org/fileformat2.html
+	X := pageSize - 35
+	M := ((pageSize - 12) * 32 / 255) - 23
+	K := M + ((payloadLen - M) % (pageSize - 4))
+	switch {
+	case payloadLen <= X:
+		return payloadLen
+	case K <= X:
+		return K
+	default:
+		return M
+	}
+}
+
+// OverflowPages returns the number of overflow pages holding the rest of c's payload.
+func (f *File) OverflowPages(c Cell) int {
+	return (c.PayloadLen - len(c.Local) + f.PageSize - 5) / (f.PageSize - 4)
+}
+
+// Payload returns the whole payload of c, reading it from its overflow pages if necessary.
+func (f *File) Payload(c Cell) ([]byte, error) {
+	payload := append(make([]byte, 0, c.PayloadLen), c.Local...)
+	page := make([]byte, f.PageSize)
+	n := c.Overflow
+	for range f.OverflowPages(c) {
+		if err := f.ReadPage(n, page); err != nil {
+			return nil, err
+		}
+		n = binary.BigEndian.Uint32(page)
+		payload = append(payload, page[4:min(len(page), 4+c.PayloadLen-len(payload))]...)
+	}
+	return payload, nil
+}
+
+// SchemaEntry is a row of the sqlite_schema table.
+type SchemaEntry struct {
+	Type, Name, TableName string
+	RootPage              uint32
+	SQL                   string
+}
+
+// Schema returns the rows of the sqlite_schema table.
+func (f *File) Schema() ([]SchemaEntry, error) {
+	var entries []SchemaEntry
+	err := f.Leaves(1, func(n uint32, page []byte) error {
+		for i := range NumCells(n, page) {
+			c, err := f.Cell(n, page, i)
+			if err != nil {
+				return err
+			}
+			payload, err := f.Payload(c)
+			if err != nil {
+				return err
+			}
+			values, err := record.Decode(payload)
+			if err != nil {
+				return fmt.Errorf("%w: sqlite_schema: %w", ErrMalformed, err)
+			}
+			if len(values) != 5 {
+				return fmt.Errorf("%w: sqlite_schema row has %d columns", ErrMalformed, len(values))
+			}
+			entries = append(entries, SchemaEntry{
+				Type:      string(values[0].Bytes),
+				Name:      string(values[1].Bytes),
+				TableName: string(values[2].Bytes),
+				RootPage:  uint32(values[3].Int),
+				SQL:       string(values[4].Bytes),
+			})
+		}
+		return nil
+	})
+	return entries, err
+}
@@ -1,6 +1,7 @@
 package pagebuf
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/jordanwade90/rawlite/internal/svarint"
 )
@@ -9,6 +10,8 @@ const (
 	DatabaseHeaderSize      = 100
 	TableLeafHeaderSize     = 8
 	TableInteriorHeaderSize = 12
+	IndexLeafHeaderSize     = 8
+	IndexInteriorHeaderSize = 12
 )
 
 // PageNumber annotates uint32s that are actually page numbers.
@@ -81,6 +84,9 @@ func (p *TableLeaf) Finish() []byte {
 // IsEmpty returns whether the TableLeaf is empty.
 func (p *TableLeaf) IsEmpty() bool { return p.numCells == 0 }
 
+// NumCells returns the number of cells in the TableLeaf.
+func (p *TableLeaf) NumCells() int { return p.numCells }
+
 // TableInterior helps write table B-tree interior nodes.
 type TableInterior struct {
 	pageNumbers  []PageNumber
@@ -197,9 +203,189 @@ func (ti *TableInterior) Remove() (pageNumber PageNumber, rowid int64) {
 	return
 }
 
+// IndexLeaf helps write index B-tree leaf nodes.
+type IndexLeaf tablePage
+
+// NewIndexLeaf returns an empty IndexLeaf.
+func NewIndexLeaf(pageSize int) *IndexLeaf {
+	return &IndexLeaf{
+		page:         make([]byte, pageSize),
+		contentStart: pageSize,
+		headerSize:   IndexLeafHeaderSize,
+	}
+}
+
+// Add tries to add a cell to an IndexLeaf, returning true if it fits.
+func (p *IndexLeaf) Add(cell []byte) bool { return (*tablePage)(p).Add(cell) }
+
+// Checkpoint records the contents of the IndexLeaf so Restore can return to it.
+func (p *IndexLeaf) Checkpoint() [2]int { return (*tablePage)(p).Checkpoint() }
+
+// Restore removes every cell added since checkpoint was taken.
+func (p *IndexLeaf) Restore(checkpoint [2]int) { (*tablePage)(p).Restore(checkpoint) }
+
+// Finish finishes writing the node, returning a page-sized slice with its contents.
+// The IndexLeaf is emptied and ready to reuse after Finish returns.
+//
+// Note that Finish returns a reference to the IndexLeaf's internal buffer;
+// do not modify the return value.
+func (p *IndexLeaf) Finish() []byte {
+	p.page[0] = 10
+	p.page[1] = 0
+	p.page[2] = 0
+	binary.BigEndian.PutUint16(p.page[3:], uint16(p.numCells))
+	binary.BigEndian.PutUint16(p.page[5:], uint16(p.contentStart))
+	p.page[7] = 0
+
+	p.contentStart = len(p.page)
+	p.numCells = 0
+	return p.page
+}
+
+// IsEmpty returns whether the IndexLeaf is empty.
+func (p *IndexLeaf) IsEmpty() bool { return p.numCells == 0 }
+
+// IndexInterior helps write index B-tree interior nodes.
+//
+// Unlike table B-trees, every key in an index B-tree is an entry in the index,
+// so each child is added along with the key that follows it,
+// formatted as an index leaf cell.
+type IndexInterior struct {
+	pageNumbers  []PageNumber
+	keys         [][]byte
+	pageSize     int
+	contentStart int
+	excessCells  int
+}
+
+// NewIndexInterior returns an empty IndexInterior.
+func NewIndexInterior(pageSize int) *IndexInterior {
+	return &IndexInterior{
+		pageSize:     pageSize,
+		contentStart: pageSize,
+	}
+}
+
+func (ii *IndexInterior) updateBookkeeping(numCells int, cellLen int) {
+	if ii.excessCells == 0 {
+		contentStart := ii.contentStart - cellLen
+		contentEnd := IndexInteriorHeaderSize + 2*numCells + 2
+		if contentStart < contentEnd {
+			ii.excessCells = 1
+		} else {
+			ii.contentStart = contentStart
+		}
+	} else {
+		ii.excessCells++
+	}
+}
+
+// Add adds a child to an IndexInterior along with the key that follows it.
+// key is nil for the last child in the B-tree.
+// Add does not retain key.
+//
+// If Add returns false, a full page of cells has been buffered;
+// call Put to write the page and make room for more.
+func (ii *IndexInterior) Add(pageNumber PageNumber, key []byte) (ok bool) {
+	ii.pageNumbers = append(ii.pageNumbers, pageNumber)
+	ii.keys = append(ii.keys, bytes.Clone(key))
+	ii.updateBookkeeping(len(ii.pageNumbers), 4+len(key))
+	return ii.excessCells < 2
+}
+
+// Length returns the number of children in the node, including excess cells.
+func (ii *IndexInterior) Length() int {
+	return len(ii.pageNumbers)
+}
+
+// Put writes an interior B-tree page to p and removes all cells used from the buffer,
+// returning the key that follows the page, to be added to its parent.
+//
+// If the index is open, call Put once whenever Add returns false and ignore empty.
+// If the index has been closed, keep calling Put until empty is true.
+func (ii *IndexInterior) Put(p []byte) (rightmostKey []byte, empty bool) {
+	if len(ii.pageNumbers) < 2 {
+		panic("degenerate node")
+	}
+
+	contentStart := len(p)
+	numCells := 0
+	limit := len(ii.pageNumbers) - ii.excessCells
+	if ii.excessCells == 1 {
+		limit--
+	}
+
+	for numCells < limit-1 {
+		contentStart -= 4 + len(ii.keys[numCells])
+		contentEnd := IndexInteriorHeaderSize + 2*numCells + 2
+		if contentStart <= contentEnd {
+			// NOTE(jw): either Add messed up the contentStart/excessCells bookkeeping
+			// or Put messed up the cell offsets.
+			panic("internal bug")
+		}
+
+		binary.BigEndian.PutUint16(p[contentEnd-2:], uint16(contentStart))
+		binary.BigEndian.PutUint32(p[contentStart:], uint32(ii.pageNumbers[numCells]))
+		copy(p[contentStart+4:], ii.keys[numCells])
+		numCells++
+	}
+	rightmostKey = ii.keys[numCells]
+
+	p[0] = 2
+	p[1] = 0
+	p[2] = 0
+	binary.BigEndian.PutUint16(p[3:], uint16(numCells))
+	binary.BigEndian.PutUint16(p[5:], uint16(contentStart))
+	p[7] = 0
+	binary.BigEndian.PutUint32(p[8:], uint32(ii.pageNumbers[numCells]))
+
+	ii.pageNumbers = append(ii.pageNumbers[:0], ii.pageNumbers[numCells+1:]...)
+	ii.keys = append(ii.keys[:0], ii.keys[numCells+1:]...)
+	ii.contentStart = ii.pageSize
+	ii.excessCells = 0
+	for i := 0; i < len(ii.pageNumbers); i++ {
+		ii.updateBookkeeping(i, 4+len(ii.keys[i]))
+	}
+
+	return rightmostKey, len(ii.pageNumbers) == 0
+}
+
+// Remove removes the most recent child added with Add.
+func (ii *IndexInterior) Remove() (pageNumber PageNumber, key []byte) {
+	if len(ii.pageNumbers) == 0 {
+		panic("empty node")
+	}
+
+	pageNumber, key = ii.pageNumbers[len(ii.pageNumbers)-1], ii.keys[len(ii.keys)-1]
+	ii.pageNumbers = ii.pageNumbers[:len(ii.pageNumbers)-1]
+	ii.keys = ii.keys[:len(ii.keys)-1]
+
+	if ii.excessCells > 0 {
+		ii.excessCells--
+	} else {
+		ii.contentStart += 4 + len(key)
+	}
+
+	return
+}
+
 // DatabaseHeader helps write the database header page
 type DatabaseHeader tablePage
 
+// HeaderFields holds the database header fields that describe the rest of the file.
+type HeaderFields struct {
+	// PageCount is the size of the database in pages.
+	PageCount uint32
+	// ChangeCounter is the file change counter.
+	// It is also written as the version-valid-for number,
+	// which tells SQLite that PageCount can be trusted.
+	ChangeCounter uint32
+	// FreelistTrunk is the first freelist trunk page, or zero if there are no free pages.
+	FreelistTrunk PageNumber
+	// FreelistCount is the number of pages on the freelist, including trunk pages.
+	FreelistCount uint32
+}
+
 // NewDatabaseHeader returns an empty DatabaseHeader.
 // The schema root page is configured to be a leaf node;
 // to make it be an interior node, call Promote.
@@ -223,7 +409,7 @@ func (p *DatabaseHeader) Add(cell []byte) bool { return (*tablePage)(p).Add(cell
 //
 // Note that Finish returns a reference to the DatabaseHeader's internal buffer;
 // do not modify the return value.
-func (p *DatabaseHeader) Finish(rightMostPointer uint32) []byte {
+func (p *DatabaseHeader) Finish(rightMostPointer uint32, fields HeaderFields) []byte {
 	// Database header
 	copy(p.page, "SQLite format 3\000")
 	if len(p.page) == 65536 {
@@ -232,9 +418,14 @@ func (p *DatabaseHeader) Finish(rightMostPointer uint32) []byte {
 		binary.BigEndian.PutUint32(p.page[16:], uint32(len(p.page)<<16)|0x0101)
 	}
 	binary.BigEndian.PutUint32(p.page[20:], 0x00402020)
+	binary.BigEndian.PutUint32(p.page[24:], fields.ChangeCounter)
+	binary.BigEndian.PutUint32(p.page[28:], fields.PageCount)
+	binary.BigEndian.PutUint32(p.page[32:], uint32(fields.FreelistTrunk))
+	binary.BigEndian.PutUint32(p.page[36:], fields.FreelistCount)
 	binary.BigEndian.PutUint32(p.page[44:], 4)
 	binary.BigEndian.PutUint32(p.page[48:], uint32(2048000/len(p.page)))
 	binary.BigEndian.PutUint32(p.page[56:], 1)
+	binary.BigEndian.PutUint32(p.page[92:], fields.ChangeCounter)
 	binary.BigEndian.PutUint32(p.page[96:], 3003000)
 
 	// sqlite_schema root page header
@@ -261,7 +452,6 @@ func (p *DatabaseHeader) Finish(rightMostPointer uint32) []byte {
 // Promote clears the node contents
 // and reconfigures the schema root page to be an interior node.
 func (p *DatabaseHeader) Promote() {
-	panic("broken")
 	p.contentStart = len(p.page)
 	p.numCells = 0
 	p.headerSize = DatabaseHeaderSize + TableInteriorHeaderSize
@@ -1,11 +1,16 @@
 package svarint
 
 import (
-	"golang.org/x/exp/constraints"
 	"math/bits"
 )
 
-func Append[T constraints.Integer](buf []byte, x T) []byte {
+// integer is the integer types varints are written from.
+// It leaves out the types narrower than 64 bits, which go vet rejects the shifts below for.
+type integer interface {
+	~int | ~int64 | ~uint64
+}
+
+func Append[T integer](buf []byte, x T) []byte {
 	xl := 64 - bits.LeadingZeros64(uint64(x))
 	switch {
 	case xl <= 7:
@@ -29,7 +34,7 @@ func Append[T constraints.Integer](buf []byte, x T) []byte {
 	}
 }
 
-func Length[T constraints.Integer](x T) int {
+func Length[T integer](x T) int {
 	xl := 64 - bits.LeadingZeros64(uint64(x))
 	switch {
 	case xl <= 7:
@@ -53,7 +58,7 @@ func Length[T constraints.Integer](x T) int {
 	}
 }
 
-func Put[T constraints.Integer](buf []byte, x T) {
+func Put[T integer](buf []byte, x T) {
 	xl := 64 - bits.LeadingZeros64(uint64(x))
 	switch {
 	case xl <= 7:
@@ -112,3 +117,24 @@ func Put[T constraints.Integer](buf []byte, x T) {
 		buf[8] = byte(x)
 	}
 }
+
+// Get decodes a varint from the start of buf,
+// returning its value and the number of bytes it occupies,
+// or 0 bytes if buf is too short.
+func Get(buf []byte) (x uint64, n int) {
+	for n < 8 {
+		if n == len(buf) {
+			return 0, 0
+		}
+		b := buf[n]
+		n++
+		x = x<<7 | uint64(b&^0x80)
+		if b&0x80 == 0 {
+			return x, n
+		}
+	}
+	if n == len(buf) {
+		return 0, 0
+	}
+	return x<<8 | uint64(buf[n]), n + 1
+}
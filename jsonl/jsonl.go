@@ -0,0 +1,323 @@
+// Package jsonl imports newline-delimited JSON, also known as JSON Lines or NDJSON,
+// into tables of a rawlite.Database.
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"iter"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Column maps a value in each JSON object to a column of the table.
+type Column struct {
+	Name string
+	// Path is the path of the value in the object:
+	// the keys leading to it, separated by dots, such as "user.id".
+	// A leading "$." is ignored, so paths may be written as in SQLite's JSON functions.
+	Path string
+	// Type is the declared type of the column, which may be empty.
+	// Values are converted as SQLite converts them when inserted into a column of this type.
+	Type string
+}
+
+// Options configures Import.
+type Options struct {
+	Columns []Column
+	// Rest, if not empty, is the name of a TEXT column that stores,
+	// as JSON, the rest of each object: the values that aren't stored in other columns.
+	// It is NULL if nothing is left.
+	Rest string
+	// Workers is the number of goroutines that decode objects;
+	// if it is less than 1, runtime.GOMAXPROCS(0) are used.
+	Workers int
+}
+
+// blockSize is the size of the blocks Import reads its input in.
+const blockSize = 1 << 20
+
+// Import reads JSON objects from r, one per line,
+// and writes one row per object to a new table of db named table,
+// with the columns described by opts.
+// Blank lines are skipped.
+// The rows are stored in the order of the input, with rowids counting up from 1.
+//
+// Input is split into chunks at line boundaries, which are decoded in parallel.
+// The value at each column's path is stored as SQLite's json_extract function would return it:
+// strings as text, numbers as integers or reals, true and false as 1 and 0,
+// and objects and arrays as JSON text.
+// A missing value or null is stored as NULL.
+//
+// An error reading r, or a line that isn't a JSON object, makes db fail
+// before the table is closed, so no partial table is written;
+// Import returns that error, which gives the line number of a bad line.
+func Import(ctx context.Context, db *rawlite.Database, table string, r io.Reader, opts Options) error {
+	dec, err := newDecoder(opts)
+	if err != nil {
+		return err
+	}
+	sql, err := dec.schema.CreateTableSQL(table)
+	if err != nil {
+		return err
+	}
+
+	// Canceling ctx makes IngestOrdered fail db before it closes the table.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	input := func(yield func(int64, line) bool) {
+		var readErr error
+		lines(r, &readErr)(yield)
+		if readErr != nil {
+			cancel(readErr)
+		}
+	}
+	encode := func(rec *record.Record, l line) error {
+		err := dec.encode(rec, l)
+		if err != nil {
+			cancel(err)
+		}
+		return err
+	}
+	return rawlite.IngestOrdered(ctx, db.OpenTable(), table, sql, input, opts.Workers, encode)
+}
+
+// CreateTableSQL returns the CREATE TABLE statement Import uses for a table named table.
+func CreateTableSQL(table string, opts Options) (string, error) {
+	dec, err := newDecoder(opts)
+	if err != nil {
+		return "", err
+	}
+	return dec.schema.CreateTableSQL(table)
+}
+
+// line is one line of the input.
+type line struct {
+	number int64
+	text   []byte
+}
+
+// lines splits the input into lines, skipping blank lines,
+// and returns them with their row numbers, which count up from 1.
+// It reads r in blocks, keeping each line in the block it was read in,
+// so the lines don't need to be copied.
+// If reading fails, it stops and sets *err.
+func lines(r io.Reader, err *error) iter.Seq2[int64, line] {
+	return func(yield func(int64, line) bool) {
+		var rowid, number int64
+		var block []byte
+		var eof bool
+		for {
+			i := bytes.IndexByte(block, '\n')
+			if i < 0 {
+				if eof {
+					if len(bytes.TrimSpace(block)) != 0 {
+						// The last line has no newline.
+						i = len(block)
+					} else {
+						return
+					}
+				} else {
+					// Start a new block with the partial line at the end of the old one.
+					next := make([]byte, len(block), max(blockSize, 2*len(block)))
+					copy(next, block)
+					n, readErr := io.ReadFull(r, next[len(block):cap(next)])
+					block = next[:len(block)+n]
+					if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+						eof = true
+					} else if readErr != nil {
+						*err = readErr
+						return
+					}
+					continue
+				}
+			}
+
+			text := block[:i]
+			block = block[min(i+1, len(block)):]
+			number++
+			if len(bytes.TrimSpace(text)) == 0 {
+				continue
+			}
+			rowid++
+			if !yield(rowid, line{number, text}) {
+				return
+			}
+		}
+	}
+}
+
+// A decoder converts lines of JSON to rows.
+type decoder struct {
+	schema rawlite.Schema
+	// paths holds the keys of each column's path.
+	paths      [][]string
+	affinities []record.Affinity
+	// rest is set if the schema has a column for the rest of the object.
+	rest bool
+	// tree holds the paths of the columns as a tree of keys,
+	// to remove them from the rest of the object.
+	tree *pathTree
+}
+
+// pathTree is a tree of the keys of column paths.
+// A nil child means the whole value under that key is stored in a column.
+type pathTree map[string]*pathTree
+
+func newDecoder(opts Options) (*decoder, error) {
+	if len(opts.Columns) == 0 && opts.Rest == "" {
+		return nil, errors.New("jsonl: no columns")
+	}
+
+	dec := &decoder{tree: &pathTree{}}
+	for _, col := range opts.Columns {
+		keys := strings.Split(strings.TrimPrefix(col.Path, "$."), ".")
+		if slices.Contains(keys, "") {
+			return nil, fmt.Errorf("jsonl: column %s: invalid path %q", col.Name, col.Path)
+		}
+		dec.paths = append(dec.paths, keys)
+		dec.affinities = append(dec.affinities, record.ColumnAffinity(col.Type))
+		dec.schema.Columns = append(dec.schema.Columns, rawlite.Column{Name: col.Name, Type: col.Type})
+
+		tree := dec.tree
+		for i, key := range keys {
+			child, ok := (*tree)[key]
+			if ok && child == nil {
+				// A parent of this path is already stored whole.
+				break
+			}
+			if i == len(keys)-1 {
+				(*tree)[key] = nil
+				break
+			}
+			if !ok {
+				child = &pathTree{}
+				(*tree)[key] = child
+			}
+			tree = child
+		}
+	}
+	if opts.Rest != "" {
+		dec.rest = true
+		dec.schema.Columns = append(dec.schema.Columns, rawlite.Column{Name: opts.Rest, Type: "TEXT"})
+	}
+	if err := dec.schema.Check(); err != nil {
+		return nil, fmt.Errorf("jsonl: %w", err)
+	}
+	return dec, nil
+}
+
+func (dec *decoder) encode(rec *record.Record, l line) error {
+	if bytes.TrimSpace(l.text)[0] != '{' {
+		return fmt.Errorf("line %d: not a JSON object", l.number)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(l.text, &obj); err != nil {
+		return fmt.Errorf("line %d: %w", l.number, err)
+	}
+
+	for i, keys := range dec.paths {
+		if err := appendValue(rec, dec.affinities[i], lookup(obj, keys)); err != nil {
+			return fmt.Errorf("line %d: %s: %w", l.number, dec.schema.Columns[i].Name, err)
+		}
+	}
+	if dec.rest {
+		if rest := removePaths(obj, dec.tree); len(rest) == 0 {
+			rec.AppendNull()
+		} else if err := rec.AppendJSON(rest); err != nil {
+			return fmt.Errorf("line %d: %w", l.number, err)
+		}
+	}
+	return nil
+}
+
+// lookup returns the value at the path keys in obj, or nil if there is none.
+func lookup(obj map[string]json.RawMessage, keys []string) json.RawMessage {
+	for {
+		v := obj[keys[0]]
+		if len(keys) == 1 || v == nil {
+			return v
+		}
+		obj = nil
+		if json.Unmarshal(v, &obj) != nil || obj == nil {
+			// The value isn't an object, so it has no keys.
+			return nil
+		}
+		keys = keys[1:]
+	}
+}
+
+// removePaths returns obj without the values whose paths are in tree.
+// It modifies obj.
+func removePaths(obj map[string]json.RawMessage, tree *pathTree) map[string]json.RawMessage {
+	for key, child := range *tree {
+		v, ok := obj[key]
+		if !ok {
+			continue
+		}
+		if child == nil {
+			delete(obj, key)
+			continue
+		}
+
+		var sub map[string]json.RawMessage
+		if json.Unmarshal(v, &sub) != nil || sub == nil {
+			// The value isn't an object, so nothing was taken from it.
+			continue
+		}
+		if sub = removePaths(sub, child); len(sub) == 0 {
+			delete(obj, key)
+		} else if b, err := json.Marshal(sub); err == nil {
+			obj[key] = b
+		}
+	}
+	return obj
+}
+
+// appendValue appends the JSON value v, converted for a column with affinity a.
+func appendValue(rec *record.Record, a record.Affinity, v json.RawMessage) error {
+	if len(v) == 0 {
+		rec.AppendNull()
+		return nil
+	}
+
+	switch v[0] {
+	case 'n':
+		rec.AppendNull()
+	case 't':
+		rec.AppendIntAs(a, 1)
+	case 'f':
+		rec.AppendIntAs(a, 0)
+	case '"':
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return err
+		}
+		rec.AppendStringAs(a, s)
+	case '{', '[':
+		var b bytes.Buffer
+		if err := json.Compact(&b, v); err != nil {
+			return err
+		}
+		rec.AppendStringSlice(b.Bytes())
+	default:
+		s := string(v)
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			rec.AppendIntAs(a, i)
+			return nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil && !errors.Is(err, strconv.ErrRange) {
+			return err
+		}
+		rec.AppendFloatAs(a, f)
+	}
+	return nil
+}
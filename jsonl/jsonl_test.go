@@ -0,0 +1,136 @@
+package jsonl_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/jsonl"
+	"github.com/jordanwade90/rawlite/verify"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// importDatabase imports the lines of in into a table named t of a new database,
+// and returns the database after checking it with verify.Check.
+func importDatabase(t *testing.T, in string, opts jsonl.Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	db := rawlite.OpenDatabaseWriter(&out, rawlite.PageSize(1024))
+	if err := jsonl.Import(context.Background(), db, "t", strings.NewReader(in), opts); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify.Check(bytes.NewReader(out.Bytes())); err != nil {
+		t.Errorf("verify.Check: %v", err)
+	}
+	return out.Bytes()
+}
+
+// querySQLite runs sql on the database data with the sqlite3 command and returns its output,
+// skipping the rest of the test if sqlite3 isn't installed.
+func querySQLite(t *testing.T, data []byte, sql string) string {
+	t.Helper()
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	name := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(name, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sqlite3, name, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s %v", sql, out, err)
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+// TestImport checks the values Import stores for nested paths, the rest column, and column types,
+// skipping blank lines and reading a last line without a newline.
+func TestImport(t *testing.T) {
+	in := `{"id": "12", "user": {"name": 42, "address": {"city": "Oslo"}, "age": 3}, "score": 3, "n": "1.5", "tags": ["a", "b"], "extra": true}` + "\n" +
+		"\n" +
+		"   \n" +
+		`{"id": 7, "user": {"name": "bo", "address": {"city": "Rome"}}, "score": 2.5, "n": "x", "tags": {"k": 1}}` + "\n" +
+		`{"id": 1e2, "user": "plain", "score": null, "n": 10, "extra": false}`
+	opts := jsonl.Options{
+		Columns: []jsonl.Column{
+			{Name: "id", Path: "$.id", Type: "INTEGER"},
+			{Name: "name", Path: "user.name", Type: "TEXT"},
+			{Name: "city", Path: "$.user.address.city"},
+			{Name: "score", Path: "score", Type: "REAL"},
+			{Name: "n", Path: "n", Type: "NUMERIC"},
+			{Name: "tags", Path: "tags"},
+		},
+		Rest: "rest",
+	}
+	data := importDatabase(t, in, opts)
+
+	want := strings.Join([]string{
+		`1|12|'42'|'Oslo'|3.0|1.5|'["a","b"]'|'{"extra":true,"user":{"age":3}}'`,
+		`2|7|'bo'|'Rome'|2.5|'x'|'{"k":1}'|NULL`,
+		`3|100|NULL|NULL|NULL|10|NULL|'{"extra":false,"user":"plain"}'`,
+	}, "\n")
+	got := querySQLite(t, data, "SELECT rowid, quote(id), quote(name), quote(city), quote(score), quote(n), quote(tags), quote(rest) FROM t ORDER BY rowid")
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	wantSQL, err := jsonl.CreateTableSQL("t", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := querySQLite(t, data, "SELECT sql FROM sqlite_schema WHERE name = 't'"); got != wantSQL {
+		t.Errorf("schema: got %s, want %s", got, wantSQL)
+	}
+}
+
+// TestImportOrder checks that rows keep the order of the file
+// when it is read in several blocks and decoded by several workers.
+func TestImportOrder(t *testing.T) {
+	const n = 100000
+	var in strings.Builder
+	for i := range n {
+		// Lines of different lengths take different times to decode.
+		fmt.Fprintf(&in, `{"a": %d, "pad": %q}`+"\n", i, strings.Repeat("x", i%50))
+	}
+	if in.Len() <= 1<<20 {
+		t.Fatalf("the input is only %d bytes, so it's read in one block", in.Len())
+	}
+	data := importDatabase(t, in.String(), jsonl.Options{Columns: []jsonl.Column{{Name: "a", Path: "a", Type: "INTEGER"}}, Workers: 4})
+
+	const query = `SELECT count(*), sum(rowid = a + 1),
+	(SELECT count(*) FROM (SELECT a - lag(a) OVER (ORDER BY rowid) AS d FROM t) WHERE d != 1)
+	FROM t`
+	if got, want := querySQLite(t, data, query), fmt.Sprintf("%d|%d|0", n, n); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// TestImportBadLine checks that a bad line makes the Database fail
+// rather than leave it with a partial table.
+func TestImportBadLine(t *testing.T) {
+	var in strings.Builder
+	for range 100000 {
+		in.WriteString(`{"a": 1}` + "\n")
+	}
+	in.WriteString("[1]\n")
+
+	var out bytes.Buffer
+	db := rawlite.OpenDatabaseWriter(&out)
+	err := jsonl.Import(context.Background(), db, "t", strings.NewReader(in.String()), jsonl.Options{Columns: []jsonl.Column{{Name: "a", Path: "a"}}})
+	if err == nil || !strings.Contains(err.Error(), "line 100001") {
+		t.Errorf("Import: got %v, want an error for line 100001", err)
+	}
+	if db.Err() == nil {
+		t.Error("Import: the Database didn't fail")
+	}
+	if err := db.Close(); err == nil || out.Len() != 0 {
+		t.Errorf("Close: got %v after writing %d bytes, want the import error and nothing written", err, out.Len())
+	}
+}
@@ -0,0 +1,232 @@
+// Package merge combines SQLite databases with the same tables into one,
+// such as the databases written by rawlite on many machines
+// for different parts of the same data.
+//
+// Rows are copied without decoding them,
+// along with their overflow pages if the page sizes match,
+// and the interior pages of each table and the sqlite_schema table are rebuilt.
+// With KeepRowids and matching page sizes, leaf pages are copied whole too,
+// with only the page numbers of the copies of their overflow pages changed.
+// Otherwise the cells of the rows are packed onto new leaf pages,
+// since renumbering the rows changes the size of their cells.
+package merge
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/internal/btree"
+	"io"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Options configures Merge.
+type Options struct {
+	// PageSize is the page size of the merged database.
+	// If it is 0, the page size of the first source is used,
+	// which allows overflow pages to be copied whole.
+	PageSize int
+	// KeepRowids keeps the rowids of the rows,
+	// so the rowids of each table must not overlap between sources.
+	// Otherwise, the rows of each table are renumbered from 1,
+	// in the order of the sources and then of their rowids,
+	// which changes the values of any INTEGER PRIMARY KEY column.
+	KeepRowids bool
+	// Workers is the number of sources copied at once;
+	// if it is less than 1, runtime.GOMAXPROCS(0) are copied at once.
+	Workers int
+}
+
+// Merge writes a database to out containing the rows of every table in the databases srcs.
+//
+// The sources must all have the same tables, with the same CREATE TABLE statements.
+// Only tables with rowids can be merged:
+// a source with an index, view, trigger, or WITHOUT ROWID table
+// makes Merge return an error wrapping errors.ErrUnsupported.
+func Merge(ctx context.Context, out io.WriterAt, srcs []io.ReaderAt, opts Options) error {
+	if len(srcs) == 0 {
+		return errors.New("merge: no sources")
+	}
+	if opts.PageSize != 0 && !rawlite.ValidPageSize(opts.PageSize) {
+		return fmt.Errorf("merge: invalid page size %d", opts.PageSize)
+	}
+
+	files := make([]*btree.File, len(srcs))
+	roots := make([]map[string]uint32, len(srcs))
+	var tables []btree.SchemaEntry
+	for i, src := range srcs {
+		f, err := btree.Open(src)
+		if err != nil {
+			return fmt.Errorf("merge: source %d: %w", i, err)
+		}
+		files[i] = f
+		entries, err := f.Schema()
+		if err != nil {
+			return fmt.Errorf("merge: source %d: %w", i, err)
+		}
+		if i == 0 {
+			tables = entries
+		}
+		if roots[i], err = checkSchema(f, tables, entries); err != nil {
+			return fmt.Errorf("merge: source %d: %w", i, err)
+		}
+	}
+
+	// Reserve a range of rowids for each source of each table,
+	// so that every source can be copied with its own stream.
+	var jobs []job
+	for t, entry := range tables {
+		var tableJobs []job
+		var base int64
+		for i, f := range files {
+			j := job{table: t, src: i, root: roots[i][entry.Name]}
+			rows, err := f.Count(j.root)
+			if err != nil {
+				return fmt.Errorf("merge: source %d: table %s: %w", i, entry.Name, err)
+			}
+			if rows == 0 {
+				continue
+			}
+			if opts.KeepRowids {
+				if j.first, j.last, err = f.RowidRange(j.root); err != nil {
+					return fmt.Errorf("merge: source %d: table %s: %w", i, entry.Name, err)
+				}
+			} else {
+				j.first, j.last = base+1, base+rows
+				base += rows
+			}
+			tableJobs = append(tableJobs, j)
+		}
+
+		if opts.KeepRowids {
+			slices.SortFunc(tableJobs, func(a, b job) int {
+				return cmp.Compare(a.first, b.first)
+			})
+			for k := 1; k < len(tableJobs); k++ {
+				if a, b := tableJobs[k-1], tableJobs[k]; a.last >= b.first {
+					return fmt.Errorf("merge: table %s: rowids of sources %d and %d overlap", entry.Name, a.src, b.src)
+				}
+			}
+		}
+		jobs = append(jobs, tableJobs...)
+	}
+
+	pageSize := opts.PageSize
+	if pageSize == 0 {
+		pageSize = files[0].PageSize
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	db := rawlite.OpenDatabaseContext(ctx, out, rawlite.PageSize(pageSize))
+	tbls := make([]*rawlite.Table, len(tables))
+	for t := range tables {
+		tbls[t] = db.OpenTable()
+	}
+
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ch := make(chan job)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range ch {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := j.copy(tbls[j.table], srcs[j.src], opts.KeepRowids); err != nil {
+					cancel(fmt.Errorf("merge: source %d: table %s: %w", j.src, tables[j.table].Name, err))
+				}
+			}
+		}()
+	}
+	for _, j := range jobs {
+		ch <- j
+	}
+	close(ch)
+	wg.Wait()
+
+	// A failed job cancels ctx, so return its error
+	// rather than close tables that are missing its rows.
+	if err := context.Cause(ctx); err != nil {
+		return err
+	}
+
+	var err error
+	for t, entry := range tables {
+		if err = tbls[t].Close(entry.Name, entry.SQL); err != nil {
+			break
+		}
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// job copies the rows of a table in one source.
+type job struct {
+	// table and src are the indexes of the table and the source.
+	table, src int
+	root       uint32
+	// first and last are the range of rowids reserved for the rows.
+	first, last int64
+}
+
+func (j job) copy(tbl *rawlite.Table, src io.ReaderAt, keepRowids bool) error {
+	s, err := tbl.OpenStreamRange(j.first, j.last)
+	if err != nil {
+		return err
+	}
+	if keepRowids {
+		err = s.CopyRowsWithID(src, j.root)
+	} else {
+		err = s.CopyRows(src, j.root)
+	}
+	if closeErr := s.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkSchema checks that the schema entries of the source f are the same as tables
+// and can be merged, and returns the root page of each table.
+func checkSchema(f *btree.File, tables, entries []btree.SchemaEntry) (map[string]uint32, error) {
+	roots := make(map[string]uint32)
+	for _, entry := range entries {
+		if entry.Type != "table" {
+			return nil, fmt.Errorf("%s %s: %w", entry.Type, entry.Name, errors.ErrUnsupported)
+		}
+		if strings.HasPrefix(strings.ToLower(entry.Name), "sqlite_") {
+			return nil, fmt.Errorf("internal table %s: %w", entry.Name, errors.ErrUnsupported)
+		}
+		if typ, err := f.PageType(entry.RootPage); err != nil {
+			return nil, fmt.Errorf("table %s: %w", entry.Name, err)
+		} else if typ != btree.TableLeaf && typ != btree.TableInterior {
+			return nil, fmt.Errorf("WITHOUT ROWID table %s: %w", entry.Name, errors.ErrUnsupported)
+		}
+		roots[entry.Name] = entry.RootPage
+	}
+
+	if len(entries) != len(tables) {
+		return nil, fmt.Errorf("has %d tables, want %d", len(entries), len(tables))
+	}
+	for _, table := range tables {
+		i := slices.IndexFunc(entries, func(e btree.SchemaEntry) bool { return e.Name == table.Name })
+		if i < 0 {
+			return nil, fmt.Errorf("missing table %s", table.Name)
+		}
+		if entries[i].SQL != table.SQL {
+			return nil, fmt.Errorf("table %s has a different definition", table.Name)
+		}
+	}
+	return roots, nil
+}
@@ -0,0 +1,194 @@
+package merge_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/merge"
+	"github.com/jordanwade90/rawlite/record"
+	"github.com/jordanwade90/rawlite/verify"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memFile is an in-memory database file.
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+// querySQLite runs sql on the database in f with the sqlite3 command and returns its output,
+// skipping the rest of the test if sqlite3 isn't installed.
+func querySQLite(t *testing.T, f *memFile, sql string) string {
+	t.Helper()
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	name := filepath.Join(t.TempDir(), "test.db")
+	if err := os.WriteFile(name, f.data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(sqlite3, name, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s %v", sql, out, err)
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+const rowsPerSource = 300
+
+// value returns column b of row j of source i, which overflows for most j at small page sizes.
+func value(i, j int) string {
+	return strings.Repeat(string(rune('a'+i)), (i*7+j*53)%2500)
+}
+
+// writeSource writes source i, with tables t and u.
+// With rowidRanges, the rows of t have rowids that don't overlap those of other sources;
+// otherwise they are assigned automatically.
+// It returns the rowids of the rows of t.
+func writeSource(t *testing.T, f *memFile, pageSize, i int, rowidRanges bool) []int64 {
+	t.Helper()
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(pageSize))
+	tbl := db.OpenTable()
+	var s *rawlite.TableStream
+	if rowidRanges {
+		var err error
+		if s, err = tbl.OpenStreamRange(int64(i)*100000+1, int64(i+1)*100000); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		s = tbl.OpenStream()
+	}
+	var rowids []int64
+	for j := range rowsPerSource {
+		var rec record.Record
+		rec.AppendString(fmt.Sprintf("%d-%d", i, j))
+		rec.AppendString(value(i, j))
+		rowid := int64(i)*100000 + int64(j)*3 + 1
+		var err error
+		if rowidRanges {
+			err = s.WriteRowWithID(rowid, rec.AppendTo(nil))
+		} else {
+			rowid, err = s.WriteRow(rec.AppendTo(nil))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		rowids = append(rowids, rowid)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+
+	// u is empty in every source but the first.
+	tbl = db.OpenTable()
+	if i == 0 {
+		s := tbl.OpenStream()
+		for j := range 5 {
+			var rec record.Record
+			rec.AppendInt(int64(j))
+			if _, err := s.WriteRow(rec.AppendTo(nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.Close("u", "CREATE TABLE u(a)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return rowids
+}
+
+// TestMerge merges databases written by rawlite and checks the rows of the result with SQLite.
+func TestMerge(t *testing.T) {
+	for _, tc := range []struct {
+		sources           int
+		pageSize, outSize int
+		keepRowids        bool
+	}{
+		{2, 1024, 0, false},
+		{3, 1024, 0, true},
+		{4, 512, 0, true},
+		{3, 1024, 4096, false},
+		{3, 4096, 512, true},
+	} {
+		t.Run(fmt.Sprintf("sources=%d/pagesize=%d/out=%d/keep=%v", tc.sources, tc.pageSize, tc.outSize, tc.keepRowids), func(t *testing.T) {
+			var srcs []io.ReaderAt
+			var want strings.Builder
+			for i := range tc.sources {
+				f := &memFile{}
+				rowids := writeSource(t, f, tc.pageSize, i, tc.keepRowids)
+				srcs = append(srcs, f)
+				for j, rowid := range rowids {
+					if !tc.keepRowids {
+						rowid = int64(i*rowsPerSource + j + 1)
+					}
+					fmt.Fprintf(&want, "%d|%d-%d|%s\n", rowid, i, j, value(i, j))
+				}
+			}
+
+			out := &memFile{}
+			if err := merge.Merge(context.Background(), out, srcs, merge.Options{PageSize: tc.outSize, KeepRowids: tc.keepRowids, Workers: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if err := verify.Check(out); err != nil {
+				t.Errorf("verify.Check: %v", err)
+			}
+			if got := querySQLite(t, out, "PRAGMA integrity_check"); got != "ok" {
+				t.Errorf("PRAGMA integrity_check: %s", got)
+			}
+			if got := querySQLite(t, out, "SELECT rowid, a, b FROM t"); got != strings.TrimSpace(want.String()) {
+				t.Errorf("rows of t differ from the sources' (got %d bytes, want %d)", len(got), want.Len())
+			}
+			if got := querySQLite(t, out, "SELECT count(*) FROM u"); got != "5" {
+				t.Errorf("u has %s rows, want 5", got)
+			}
+		})
+	}
+}
+
+// TestMergeOverlappingRowids checks that KeepRowids rejects sources whose rowids overlap.
+func TestMergeOverlappingRowids(t *testing.T) {
+	var srcs []io.ReaderAt
+	for i := range 2 {
+		f := &memFile{}
+		writeSource(t, f, 1024, i, false)
+		srcs = append(srcs, f)
+	}
+	err := merge.Merge(context.Background(), &memFile{}, srcs, merge.Options{KeepRowids: true})
+	if err == nil || !strings.Contains(err.Error(), "overlap") {
+		t.Errorf("got %v, want an error about overlapping rowids", err)
+	}
+}
@@ -0,0 +1,33 @@
+package rawlite_test
+
+import (
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"strings"
+	"testing"
+)
+
+// TestOverflowChains checks rows that need one or several overflow pages.
+func TestOverflowChains(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	s := tbl.OpenStream()
+	for _, n := range []int{400, 600, 1000, 5000, 100000} {
+		var rec record.Record
+		rec.AppendString(strings.Repeat("x", n))
+		if _, err := s.WriteRow(rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+}
@@ -0,0 +1,135 @@
+package record
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Affinity is the type affinity of a column,
+// which determines how SQLite converts values stored in it.
+// See https://sqlite.org/datatype3.html#type_affinity
+type Affinity uint8
+
+const (
+	BlobAffinity Affinity = iota
+	TextAffinity
+	NumericAffinity
+	IntegerAffinity
+	RealAffinity
+)
+
+func (a Affinity) String() string {
+	switch a {
+	case BlobAffinity:
+		return "BLOB"
+	case TextAffinity:
+		return "TEXT"
+	case NumericAffinity:
+		return "NUMERIC"
+	case IntegerAffinity:
+		return "INTEGER"
+	case RealAffinity:
+		return "REAL"
+	default:
+		return "Affinity(" + strconv.Itoa(int(a)) + ")"
+	}
+}
+
+// ColumnAffinity returns the affinity of a column with the declared type declType,
+// using the rules SQLite uses.
+func ColumnAffinity(declType string) Affinity {
+	declType = strings.ToUpper(declType)
+	switch {
+	case strings.Contains(declType, "INT"):
+		return IntegerAffinity
+	case strings.Contains(declType, "CHAR"), strings.Contains(declType, "CLOB"), strings.Contains(declType, "TEXT"):
+		return TextAffinity
+	case strings.Contains(declType, "BLOB"), declType == "":
+		return BlobAffinity
+	case strings.Contains(declType, "REAL"), strings.Contains(declType, "FLOA"), strings.Contains(declType, "DOUB"):
+		return RealAffinity
+	default:
+		return NumericAffinity
+	}
+}
+
+// Accepts reports whether SQLite would store v unchanged in a column with affinity a.
+// Values it would convert, such as a number in a TEXT column
+// or text that looks like a number in a NUMERIC column,
+// are not accepted, since rawlite stores values exactly as they are encoded.
+func (a Affinity) Accepts(v Value) bool {
+	switch a {
+	case TextAffinity:
+		return v.Kind != Int && v.Kind != Float
+	case NumericAffinity, IntegerAffinity, RealAffinity:
+		if v.Kind == Float && a != RealAffinity {
+			// Integral reals are converted to integers.
+			return !isIntegral(v.Float)
+		}
+		if v.Kind == Int && a == RealAffinity {
+			// Integers that don't fit in 6 bytes are converted to reals.
+			return isIntReal(v.Int)
+		}
+		return v.Kind != Text || !IsNumeric(v.Bytes)
+	default:
+		return true
+	}
+}
+
+// IsNumeric reports whether SQLite would convert the text s to a number
+// when storing it in a column with NUMERIC, INTEGER, or REAL affinity:
+// that is, whether s is a decimal integer or real literal,
+// optionally surrounded by whitespace.
+func IsNumeric(s []byte) bool {
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && (s[i] == ' ' || '\t' <= s[i] && s[i] <= '\r') {
+			i++
+		}
+	}
+	digits := func() int {
+		start := i
+		for i < len(s) && '0' <= s[i] && s[i] <= '9' {
+			i++
+		}
+		return i - start
+	}
+
+	skipSpace()
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	n := digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		n += digits()
+	}
+	if n == 0 {
+		return false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	skipSpace()
+	return i == len(s)
+}
+
+// isIntReal reports whether SQLite keeps the integer i as an integer
+// when storing it in a column with REAL affinity,
+// which it only does if i fits in 6 bytes.
+func isIntReal(i int64) bool {
+	return i >= -0x8000_0000_0000 && i <= 0x7fff_ffff_ffff
+}
+
+// isIntegral reports whether SQLite would convert the real f to an integer
+// when storing it in a column with NUMERIC or INTEGER affinity.
+func isIntegral(f float64) bool {
+	return f == math.Trunc(f) && f > math.MinInt64 && f < math.MaxInt64
+}
@@ -0,0 +1,214 @@
+package record
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The AppendXAs methods append a value converted the way SQLite converts
+// a value of that type inserted into a column with the given affinity,
+// so the record is byte-for-byte what SQLite would have stored.
+// Blobs and NULLs are never converted; use AppendBlob and AppendNull for them.
+
+// AppendIntAs appends i as SQLite would store it in a column with affinity a.
+func (record *Record) AppendIntAs(a Affinity, i int64) {
+	switch {
+	case a == TextAffinity:
+		record.AppendString(strconv.FormatInt(i, 10))
+	case a == RealAffinity && !isIntReal(i):
+		record.appendReal(float64(i))
+	default:
+		record.AppendInt(i)
+	}
+}
+
+// AppendFloatAs appends f as SQLite would store it in a column with affinity a.
+// NaN is stored as NULL.
+func (record *Record) AppendFloatAs(a Affinity, f float64) {
+	switch {
+	case math.IsNaN(f):
+		record.AppendNull()
+	case a == TextAffinity:
+		record.AppendString(FormatReal(f))
+	case a == BlobAffinity || !isIntegral(f):
+		record.appendReal(f)
+	default:
+		// SQLite stores integral reals as integers, even in REAL columns.
+		record.AppendIntAs(a, int64(f))
+	}
+}
+
+// AppendStringAs appends s as SQLite would store it in a column with affinity a.
+// Text that IsNumeric is converted to a number in a NUMERIC, INTEGER, or REAL column.
+func (record *Record) AppendStringAs(a Affinity, s string) {
+	if a == TextAffinity || a == BlobAffinity || !IsNumeric([]byte(s)) {
+		record.AppendString(s)
+		return
+	}
+
+	s = strings.Trim(s, " \t\n\v\f\r")
+	if !strings.ContainsAny(s, ".eE") {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			record.AppendIntAs(a, i)
+			return
+		}
+	}
+	// ParseFloat returns ±Inf if s is out of range, which is what SQLite stores.
+	f, _ := strconv.ParseFloat(s, 64)
+	record.AppendFloatAs(a, f)
+}
+
+// appendReal appends f as a real, even if it is integral.
+func (record *Record) appendReal(f float64) {
+	record.header = append(record.header, 7)
+	record.payload = binary.BigEndian.AppendUint64(record.payload, math.Float64bits(f))
+}
+
+// FormatReal formats f as SQLite converts a real to text:
+// with 15 significant digits, like printf's "%.15g",
+// but always with a decimal point.
+func FormatReal(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case f == 0:
+		return "0.0"
+	}
+
+	var b strings.Builder
+	if f < 0 {
+		b.WriteString("-")
+		f = -f
+	}
+	digits, exp := decodeReal(f, 15)
+
+	// digit returns the next significant digit, or '0' once they run out.
+	digit := func() byte {
+		if digits == "" {
+			return '0'
+		}
+		d := digits[0]
+		digits = digits[1:]
+		return d
+	}
+
+	if exp < -4 || exp > 14 {
+		b.WriteByte(digit())
+		b.WriteByte('.')
+		if digits == "" {
+			b.WriteByte('0')
+		}
+		b.WriteString(digits)
+		sign := "+"
+		if exp < 0 {
+			sign, exp = "-", -exp
+		}
+		fmt.Fprintf(&b, "e%s%02d", sign, exp)
+		return b.String()
+	}
+
+	if exp < 0 {
+		b.WriteString("0.")
+		b.WriteString(strings.Repeat("0", -exp-1))
+		b.WriteString(digits)
+		return b.String()
+	}
+	for i := 0; i <= exp; i++ {
+		b.WriteByte(digit())
+	}
+	b.WriteByte('.')
+	if digits == "" {
+		b.WriteByte('0')
+	}
+	b.WriteString(digits)
+	return b.String()
+}
+
+// decodeReal returns the significant digits of f > 0 rounded to n digits,
+// without trailing zeros, and the decimal exponent of the first digit.
+//
+// It follows sqlite3FpDecode from SQLite 3.43 and later rather than strconv,
+// since the two disagree about some values that are very close to halfway:
+// SQLite scales f to a 19-digit integer using double-double arithmetic,
+// then rounds that integer half up.
+func decodeReal(f float64, n int) (digits string, exp int) {
+	rr := [2]float64{f, 0}
+	if rr[0] > 9.223372036854774784e+18 {
+		for rr[0] > 9.223372036854774784e+118 {
+			exp += 100
+			dekkerMul2(&rr, 1.0e-100, -1.99918998026028836196e-117)
+		}
+		for rr[0] > 9.223372036854774784e+28 {
+			exp += 10
+			dekkerMul2(&rr, 1.0e-10, -3.6432197315497741579e-27)
+		}
+		for rr[0] > 9.223372036854774784e+18 {
+			exp++
+			dekkerMul2(&rr, 1.0e-01, -5.5511151231257827021e-18)
+		}
+	} else {
+		for rr[0] < 9.223372036854774784e-83 {
+			exp -= 100
+			dekkerMul2(&rr, 1.0e+100, -1.5902891109759918046e+83)
+		}
+		for rr[0] < 9.223372036854774784e+07 {
+			exp -= 10
+			dekkerMul2(&rr, 1.0e+10, 0)
+		}
+		for rr[0] < 9.22337203685477478e+17 {
+			exp--
+			dekkerMul2(&rr, 1.0e+01, 0)
+		}
+	}
+	var v uint64
+	if rr[1] < 0 {
+		v = uint64(rr[0]) - uint64(-rr[1])
+	} else {
+		v = uint64(rr[0]) + uint64(rr[1])
+	}
+
+	z := []byte(strconv.FormatUint(v, 10))
+	exp += len(z) - 1
+	if len(z) > n {
+		roundUp := z[n] >= '5'
+		z = z[:n]
+		for i := n - 1; roundUp; i-- {
+			if i < 0 {
+				z = append([]byte{'1'}, z...)
+				exp++
+				break
+			}
+			if z[i]++; z[i] <= '9' {
+				break
+			}
+			z[i] = '0'
+		}
+	}
+	return strings.TrimRight(string(z), "0"), exp
+}
+
+// dekkerMul2 multiplies the double-double x by the double-double (y, yy).
+// The explicit float64 conversions keep the compiler from fusing
+// multiplications and additions, which would change the rounding.
+func dekkerMul2(x *[2]float64, y, yy float64) {
+	const mask = 0xffff_ffff_fc00_0000
+	hx := math.Float64frombits(math.Float64bits(x[0]) & mask)
+	tx := x[0] - hx
+	hy := math.Float64frombits(math.Float64bits(y) & mask)
+	ty := y - hy
+	p := float64(hx * hy)
+	q := float64(hx*ty) + float64(tx*hy)
+	c := p + q
+	cc := p - c + q + float64(tx*ty)
+	cc = float64(x[0]*yy) + float64(x[1]*y) + cc
+	x[0] = c + cc
+	x[1] = c - x[0]
+	x[1] += cc
+}
@@ -0,0 +1,137 @@
+package record_test
+
+import (
+	"github.com/jordanwade90/rawlite/record"
+	"math"
+	"testing"
+)
+
+// The expected values are what SQLite stores on disk for the same inserts.
+// Note that in a REAL column, SQLite stores integral values that fit in 6 bytes as integers.
+
+func intValue(i int64) record.Value     { return record.Value{Kind: record.Int, Int: i} }
+func floatValue(f float64) record.Value { return record.Value{Kind: record.Float, Float: f} }
+func textValue(s string) record.Value   { return record.Value{Kind: record.Text, Bytes: []byte(s)} }
+
+func TestAppendStringAs(t *testing.T) {
+	for _, tc := range []struct {
+		a    record.Affinity
+		s    string
+		want record.Value
+	}{
+		{record.IntegerAffinity, " 12 ", intValue(12)},
+		{record.IntegerAffinity, "1e3", intValue(1000)},
+		{record.IntegerAffinity, "0x10", textValue("0x10")},
+		{record.IntegerAffinity, "1.0", intValue(1)},
+		{record.IntegerAffinity, "1.5", floatValue(1.5)},
+		{record.IntegerAffinity, "9223372036854775808", floatValue(9223372036854775808)},
+		{record.IntegerAffinity, "12abc", textValue("12abc")},
+		{record.RealAffinity, " 12 ", intValue(12)},
+		{record.RealAffinity, "1e3", intValue(1000)},
+		{record.RealAffinity, "0x10", textValue("0x10")},
+		{record.RealAffinity, "140737488355327", intValue(0x7fff_ffff_ffff)},
+		{record.RealAffinity, "140737488355328", floatValue(0x8000_0000_0000)},
+		{record.NumericAffinity, " 12 ", intValue(12)},
+		{record.NumericAffinity, "1e3", intValue(1000)},
+		{record.NumericAffinity, "0x10", textValue("0x10")},
+		{record.NumericAffinity, "1.0", intValue(1)},
+		{record.NumericAffinity, "1.5", floatValue(1.5)},
+		{record.TextAffinity, " 12 ", textValue(" 12 ")},
+		{record.TextAffinity, "1e3", textValue("1e3")},
+		{record.BlobAffinity, "1.0", textValue("1.0")},
+	} {
+		var rec record.Record
+		rec.AppendStringAs(tc.a, tc.s)
+		if got := decodeOne(t, &rec); !equal(got, tc.want) {
+			t.Errorf("%q in %v column: got %+v, want %+v", tc.s, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestAppendIntAs(t *testing.T) {
+	for _, tc := range []struct {
+		a    record.Affinity
+		i    int64
+		want record.Value
+	}{
+		{record.IntegerAffinity, math.MaxInt64, intValue(math.MaxInt64)},
+		{record.RealAffinity, 12, intValue(12)},
+		{record.RealAffinity, 0x7fff_ffff_ffff, intValue(0x7fff_ffff_ffff)},
+		{record.RealAffinity, -0x8000_0000_0000, intValue(-0x8000_0000_0000)},
+		{record.RealAffinity, 0x8000_0000_0000, floatValue(0x8000_0000_0000)},
+		{record.RealAffinity, -0x8000_0000_0001, floatValue(-0x8000_0000_0001)},
+		{record.RealAffinity, math.MaxInt64, floatValue(math.MaxInt64)},
+		{record.NumericAffinity, 0x8000_0000_0000, intValue(0x8000_0000_0000)},
+		{record.TextAffinity, -12, textValue("-12")},
+		{record.BlobAffinity, 12, intValue(12)},
+	} {
+		var rec record.Record
+		rec.AppendIntAs(tc.a, tc.i)
+		if got := decodeOne(t, &rec); !equal(got, tc.want) {
+			t.Errorf("%d in %v column: got %+v, want %+v", tc.i, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestAppendFloatAs(t *testing.T) {
+	for _, tc := range []struct {
+		a    record.Affinity
+		f    float64
+		want record.Value
+	}{
+		{record.IntegerAffinity, 2, intValue(2)},
+		{record.IntegerAffinity, 1.5, floatValue(1.5)},
+		{record.RealAffinity, 2, intValue(2)},
+		{record.RealAffinity, 0x8000_0000_0000, floatValue(0x8000_0000_0000)},
+		{record.NumericAffinity, 2, intValue(2)},
+		{record.TextAffinity, 2, textValue("2.0")},
+		{record.TextAffinity, 1.5, textValue("1.5")},
+		{record.BlobAffinity, 2, floatValue(2)},
+		{record.IntegerAffinity, math.NaN(), record.Value{Kind: record.Null}},
+	} {
+		var rec record.Record
+		rec.AppendFloatAs(tc.a, tc.f)
+		if got := decodeOne(t, &rec); !equal(got, tc.want) {
+			t.Errorf("%v in %v column: got %+v, want %+v", tc.f, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	for _, tc := range []struct {
+		a    record.Affinity
+		v    record.Value
+		want bool
+	}{
+		{record.RealAffinity, intValue(12), true},
+		{record.RealAffinity, intValue(0x7fff_ffff_ffff), true},
+		{record.RealAffinity, intValue(-0x8000_0000_0000), true},
+		{record.RealAffinity, intValue(0x8000_0000_0000), false},
+		{record.RealAffinity, intValue(-0x8000_0000_0001), false},
+		{record.RealAffinity, intValue(math.MaxInt64), false},
+		{record.RealAffinity, floatValue(0x8000_0000_0000), true},
+		{record.RealAffinity, textValue("12"), false},
+		{record.IntegerAffinity, intValue(math.MaxInt64), true},
+		{record.IntegerAffinity, floatValue(2), false},
+		{record.IntegerAffinity, floatValue(1.5), true},
+		{record.NumericAffinity, intValue(0x8000_0000_0000), true},
+		{record.NumericAffinity, textValue("abc"), true},
+		{record.TextAffinity, intValue(12), false},
+		{record.TextAffinity, textValue("12"), true},
+		{record.BlobAffinity, floatValue(2), true},
+	} {
+		if got := tc.a.Accepts(tc.v); got != tc.want {
+			t.Errorf("%v affinity accepts %+v: got %v, want %v", tc.a, tc.v, got, tc.want)
+		}
+	}
+}
+
+// decodeOne decodes the only column of rec.
+func decodeOne(t *testing.T, rec *record.Record) record.Value {
+	t.Helper()
+	values, err := record.Decode(rec.AppendTo(nil))
+	if err != nil || len(values) != 1 {
+		t.Fatalf("decoding %v: %v", values, err)
+	}
+	return values[0]
+}
@@ -0,0 +1,160 @@
+package record
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/jordanwade90/rawlite/internal/svarint"
+	"io"
+	"math"
+	"strconv"
+)
+
+// ErrMalformed is returned when decoding a record that isn't validly encoded.
+var ErrMalformed = errors.New("malformed record")
+
+// Kind is the storage class of a Value.
+type Kind uint8
+
+const (
+	Null Kind = iota
+	Int
+	Float
+	Text
+	Blob
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Null:
+		return "NULL"
+	case Int:
+		return "INTEGER"
+	case Float:
+		return "REAL"
+	case Text:
+		return "TEXT"
+	case Blob:
+		return "BLOB"
+	default:
+		return "Kind(" + strconv.Itoa(int(k)) + ")"
+	}
+}
+
+// Value is one column of a decoded record.
+// Int is set for Int values, Float for Float values,
+// and Bytes for Text and Blob values.
+type Value struct {
+	Kind  Kind
+	Int   int64
+	Float float64
+	Bytes []byte
+}
+
+// Decoder reads the columns of a serialized record in order.
+// The zero Decoder is empty; call Reset to start decoding a record.
+type Decoder struct {
+	header  []byte
+	payload []byte
+}
+
+// Reset starts decoding the record p, discarding any remaining columns.
+// The Values returned by Next refer to p and are only valid as long as p is.
+func (d *Decoder) Reset(p []byte) error {
+	d.header, d.payload = nil, nil
+
+	headerSize, n := svarint.Get(p)
+	if n == 0 || headerSize < uint64(n) || headerSize > uint64(len(p)) {
+		return ErrMalformed
+	}
+	d.header, d.payload = p[n:headerSize], p[headerSize:]
+	return nil
+}
+
+// Next decodes the next column of the record.
+// It returns io.EOF after the last column.
+func (d *Decoder) Next() (Value, error) {
+	if len(d.header) == 0 {
+		if len(d.payload) != 0 {
+			return Value{}, ErrMalformed
+		}
+		return Value{}, io.EOF
+	}
+
+	serialType, n := svarint.Get(d.header)
+	if n == 0 {
+		return Value{}, ErrMalformed
+	}
+	size := serialTypeSize(serialType)
+	if size < 0 || size > len(d.payload) {
+		return Value{}, ErrMalformed
+	}
+	d.header = d.header[n:]
+	data := d.payload[:size:size]
+	d.payload = d.payload[size:]
+
+	switch {
+	case serialType == 0:
+		return Value{Kind: Null}, nil
+	case serialType <= 6:
+		// Sign-extend the big-endian integer.
+		i := int64(0)
+		if data[0]&0x80 != 0 {
+			i = -1
+		}
+		for _, b := range data {
+			i = i<<8 | int64(b)
+		}
+		return Value{Kind: Int, Int: i}, nil
+	case serialType == 7:
+		return Value{Kind: Float, Float: math.Float64frombits(binary.BigEndian.Uint64(data))}, nil
+	case serialType == 8:
+		return Value{Kind: Int, Int: 0}, nil
+	case serialType == 9:
+		return Value{Kind: Int, Int: 1}, nil
+	case serialType%2 == 0:
+		return Value{Kind: Blob, Bytes: data}, nil
+	default:
+		return Value{Kind: Text, Bytes: data}, nil
+	}
+}
+
+// Decode decodes every column of the record p.
+// The Values refer to p and are only valid as long as p is.
+func Decode(p []byte) ([]Value, error) {
+	var d Decoder
+	if err := d.Reset(p); err != nil {
+		return nil, err
+	}
+
+	var values []Value
+	for {
+		v, err := d.Next()
+		if err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+}
+
+// serialTypeSize returns the size of a value with the given serial type,
+// or -1 if the serial type is reserved.
+func serialTypeSize(serialType uint64) int {
+	switch serialType {
+	case 0, 8, 9:
+		return 0
+	case 1, 2, 3, 4:
+		return int(serialType)
+	case 5:
+		return 6
+	case 6, 7:
+		return 8
+	case 10, 11:
+		return -1
+	}
+	if serialType > math.MaxInt32 {
+		return -1
+	}
+	return int(serialType-12) / 2
+}
@@ -0,0 +1,271 @@
+package record
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Encoder appends values of the struct type T to Records,
+// one column per exported field.
+//
+// Fields are encoded in order, including the fields of embedded structs,
+// and can be customized with a struct tag of the form
+//
+//	`rawlite:"name,type:TYPE,json"`
+//
+// where name is the column name,
+// TYPE is the rest of the column definition (inferred from the field's type if empty),
+// and the json option stores the field as JSON text using encoding/json.
+// The "type:" prefix may be left out, and TYPE may contain commas, as in DECIMAL(10,2).
+// If name is empty, the name from the field's json tag is used, or else the field name.
+// A field tagged `rawlite:"-"` is skipped.
+//
+// Integers and bools are stored as integers, floats as reals,
+// strings as text, and byte slices as blobs,
+// then converted as SQLite would convert them on insert into a column of the declared type,
+// using the AppendXAs methods.
+// The inferred types need no conversion,
+// except that integral floats are stored as integers when they fit in 6 bytes, as SQLite does.
+// SQLite's integers are signed, so Append returns an error for an unsigned value
+// greater than math.MaxInt64 rather than store it as a different number.
+// Nil pointers and NaNs are stored as NULL, and other pointers as the value they point to.
+//
+// A column declared as INTEGER PRIMARY KEY is an alias for the rowid,
+// so its field must be a signed integer and it is always stored as NULL.
+// Get its value with Rowid and write it with TableStream.WriteRowWithID;
+// otherwise it is lost.
+type Encoder[T any] struct {
+	fields []encoderField
+	// rowid is the index in fields of the INTEGER PRIMARY KEY column, or -1.
+	rowid int
+}
+
+type encoderField struct {
+	index    []int
+	name     string
+	declType string
+	affinity Affinity
+	// rowid is set when the column is an alias for the rowid.
+	rowid bool
+	// json is set when the field is stored as JSON.
+	json bool
+	// pointers is the number of pointers to follow to reach the value.
+	pointers int
+	kind     reflect.Kind
+}
+
+// NewEncoder returns an Encoder for T,
+// or an error if T isn't a struct or has a field that can't be stored.
+func NewEncoder[T any]() (*Encoder[T], error) {
+	t := reflect.TypeFor[T]()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("record: %v is not a struct", t)
+	}
+
+	e := &Encoder[T]{rowid: -1}
+	for _, sf := range reflect.VisibleFields(t) {
+		if !sf.IsExported() || sf.Anonymous && isStruct(sf.Type) {
+			continue
+		}
+
+		tag := sf.Tag.Get("rawlite")
+		if tag == "-" {
+			continue
+		}
+		parts := strings.Split(tag, ",")
+		f := encoderField{index: sf.Index, name: parts[0]}
+		if f.name == "" {
+			f.name, _, _ = strings.Cut(sf.Tag.Get("json"), ",")
+		}
+		if f.name == "" || f.name == "-" {
+			f.name = sf.Name
+		}
+		if len(parts) > 1 && parts[len(parts)-1] == "json" {
+			f.json = true
+			parts = parts[:len(parts)-1]
+		}
+		if len(parts) > 1 {
+			// The type may itself contain commas, as in DECIMAL(10,2).
+			f.declType = strings.TrimSpace(strings.Join(parts[1:], ","))
+			f.declType = strings.TrimSpace(strings.TrimPrefix(f.declType, "type:"))
+		}
+
+		ft := sf.Type
+		for ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+			f.pointers++
+		}
+		f.kind = ft.Kind()
+
+		inferred := ""
+		switch {
+		case f.json:
+			inferred = "TEXT"
+		case f.kind == reflect.Bool || reflect.Int <= f.kind && f.kind <= reflect.Uintptr:
+			inferred = "INTEGER"
+		case f.kind == reflect.Float32 || f.kind == reflect.Float64:
+			inferred = "REAL"
+		case f.kind == reflect.String:
+			inferred = "TEXT"
+		case f.kind == reflect.Slice && ft.Elem().Kind() == reflect.Uint8:
+			inferred = "BLOB"
+		default:
+			return nil, fmt.Errorf("record: field %s has unsupported type %v", sf.Name, sf.Type)
+		}
+		if f.declType == "" {
+			f.declType = inferred
+		}
+		f.affinity = ColumnAffinity(f.declType)
+
+		words := strings.Fields(strings.ToUpper(f.declType))
+		f.rowid = len(words) >= 3 && words[0] == "INTEGER" && words[1] == "PRIMARY" && words[2] == "KEY"
+		if f.rowid {
+			if f.json || f.kind < reflect.Int || f.kind > reflect.Int64 {
+				return nil, fmt.Errorf("record: INTEGER PRIMARY KEY field %s has type %v, not a signed integer", sf.Name, sf.Type)
+			}
+			if e.rowid >= 0 {
+				return nil, fmt.Errorf("record: fields %s and %s are both INTEGER PRIMARY KEY", e.fields[e.rowid].name, f.name)
+			}
+			e.rowid = len(e.fields)
+		}
+
+		e.fields = append(e.fields, f)
+	}
+	return e, nil
+}
+
+// Columns returns the names of the columns, in order.
+func (e *Encoder[T]) Columns() []string {
+	names := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		names[i] = f.name
+	}
+	return names
+}
+
+// CreateTableSQL returns a CREATE TABLE statement for a table named name
+// whose columns match the records written by the Encoder.
+func (e *Encoder[T]) CreateTableSQL(name string) string {
+	var b strings.Builder
+	b.WriteString("CREATE TABLE ")
+	b.WriteString(QuoteIdentifier(name))
+	b.WriteString(" (")
+	for i, f := range e.fields {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(QuoteIdentifier(f.name))
+		b.WriteString(" ")
+		b.WriteString(f.declType)
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// Append appends the fields of v to record.
+// It returns an error if a field stored as JSON can't be marshaled
+// or an unsigned integer field is greater than math.MaxInt64,
+// in which case record holds only the fields before it.
+func (e *Encoder[T]) Append(record *Record, v *T) error {
+	rv := reflect.ValueOf(v).Elem()
+	for _, f := range e.fields {
+		if f.rowid {
+			record.AppendNull()
+			continue
+		}
+
+		fv, ok := f.value(rv)
+		if !ok {
+			record.AppendNull()
+			continue
+		}
+		if f.json {
+			s, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return fmt.Errorf("record: field %s: %w", f.name, err)
+			}
+			record.AppendStringAs(f.affinity, string(s))
+			continue
+		}
+
+		switch f.kind {
+		case reflect.Bool:
+			if fv.Bool() {
+				record.AppendIntAs(f.affinity, 1)
+			} else {
+				record.AppendIntAs(f.affinity, 0)
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			record.AppendIntAs(f.affinity, fv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u := fv.Uint()
+			if u > math.MaxInt64 {
+				return fmt.Errorf("record: field %s: %d overflows a signed 64-bit integer", f.name, u)
+			}
+			record.AppendIntAs(f.affinity, int64(u))
+		case reflect.Float32, reflect.Float64:
+			record.AppendFloatAs(f.affinity, fv.Float())
+		case reflect.String:
+			record.AppendStringAs(f.affinity, fv.String())
+		case reflect.Slice:
+			if fv.IsNil() {
+				record.AppendNull()
+			} else {
+				record.AppendBlob(fv.Bytes())
+			}
+		}
+	}
+	return nil
+}
+
+// Rowid returns the value of v's INTEGER PRIMARY KEY field,
+// which Append stores as NULL, for use with TableStream.WriteRowWithID.
+// It returns false if T has no such field or the field is NULL,
+// in which case the row should be written with TableStream.WriteRow.
+func (e *Encoder[T]) Rowid(v *T) (rowid int64, ok bool) {
+	if e.rowid < 0 {
+		return 0, false
+	}
+	fv, ok := e.fields[e.rowid].value(reflect.ValueOf(v).Elem())
+	if !ok {
+		return 0, false
+	}
+	return fv.Int(), true
+}
+
+// value returns the field f of the struct rv, following pointers,
+// or false if the field is NULL because a pointer to it is nil.
+// Fields stored as JSON are returned without following pointers.
+func (f *encoderField) value(rv reflect.Value) (reflect.Value, bool) {
+	fv, err := rv.FieldByIndexErr(f.index)
+	if err != nil {
+		// The field is in an embedded struct reached through a nil pointer.
+		return reflect.Value{}, false
+	}
+	if f.json {
+		return fv, true
+	}
+	for i := 0; i < f.pointers; i++ {
+		if fv.IsNil() {
+			return reflect.Value{}, false
+		}
+		fv = fv.Elem()
+	}
+	return fv, true
+}
+
+// isStruct reports whether t is a struct or a pointer to one.
+func isStruct(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// QuoteIdentifier quotes name for use as an identifier in SQL.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
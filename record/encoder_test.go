@@ -0,0 +1,376 @@
+package record_test
+
+import (
+	"bytes"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestEncoderUint checks that unsigned fields are stored as the same number or rejected.
+func TestEncoderUint(t *testing.T) {
+	type row struct {
+		U uint64
+	}
+	enc, err := record.NewEncoder[row]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec record.Record
+	if err := enc.Append(&rec, &row{U: math.MaxInt64}); err != nil {
+		t.Fatalf("Append(MaxInt64): %v", err)
+	}
+	var d record.Decoder
+	if err := d.Reset(rec.AppendTo(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Next(); err != nil || v.Kind != record.Int || v.Int != math.MaxInt64 {
+		t.Errorf("decoding MaxInt64: got %+v, %v", v, err)
+	}
+
+	rec.Reset()
+	if err := enc.Append(&rec, &row{U: math.MaxInt64 + 1}); err == nil {
+		t.Error("Append(MaxInt64+1): no error")
+	}
+}
+
+// encode appends v with a new Encoder for T and decodes the columns of the record.
+func encode[T any](t *testing.T, v *T) []record.Value {
+	t.Helper()
+	enc, err := record.NewEncoder[T]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec record.Record
+	if err := enc.Append(&rec, v); err != nil {
+		t.Fatal(err)
+	}
+
+	var d record.Decoder
+	if err := d.Reset(rec.AppendTo(nil)); err != nil {
+		t.Fatal(err)
+	}
+	var values []record.Value
+	for {
+		v, err := d.Next()
+		if err == io.EOF {
+			return values
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, v)
+	}
+}
+
+// checkValues checks that got and want hold the same values.
+func checkValues(t *testing.T, got, want []record.Value) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d columns, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if !equal(got[i], want[i]) {
+			t.Errorf("column %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+var nullValue = record.Value{Kind: record.Null}
+
+// TestEncoderTags checks the column names and types given by struct tags.
+func TestEncoderTags(t *testing.T) {
+	type row struct {
+		Plain    int
+		Named    int    `rawlite:"named"`
+		Typed    int    `rawlite:"typed,type:NUMERIC NOT NULL"`
+		Bare     int    `rawlite:",BIGINT"`
+		Decimal  string `rawlite:"price,type:DECIMAL(10,2)"`
+		JSONName string `json:"json_name,omitempty"`
+		Override string `rawlite:"over" json:"under"`
+		JSONSkip string `json:"-"`
+		Skipped  string `rawlite:"-"`
+		Object   []int  `rawlite:"list,json"`
+		TypedObj []int  `rawlite:",type:BLOB,json"`
+		hidden   int
+	}
+	enc, err := record.NewEncoder[row]()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Plain", "named", "typed", "Bare", "price", "json_name", "over", "JSONSkip", "list", "TypedObj"}
+	if got := enc.Columns(); !slices.Equal(got, want) {
+		t.Errorf("Columns: got %q, want %q", got, want)
+	}
+	wantSQL := `CREATE TABLE "t" ("Plain" INTEGER, "named" INTEGER, "typed" NUMERIC NOT NULL, "Bare" BIGINT, ` +
+		`"price" DECIMAL(10,2), "json_name" TEXT, "over" TEXT, "JSONSkip" TEXT, "list" TEXT, "TypedObj" BLOB)`
+	if got := enc.CreateTableSQL("t"); got != wantSQL {
+		t.Errorf("CreateTableSQL:\ngot  %s\nwant %s", got, wantSQL)
+	}
+
+	got := encode(t, &row{Decimal: "1.50", Object: []int{1, 2}, TypedObj: nil, hidden: 1})
+	checkValues(t, got, []record.Value{
+		intValue(0), intValue(0), intValue(0), intValue(0),
+		floatValue(1.5), textValue(""), textValue(""), textValue(""),
+		textValue("[1,2]"), textValue("null"),
+	})
+}
+
+// TestEncoderEmbedded checks that the fields of embedded structs are encoded in order,
+// and as NULL when they're reached through a nil pointer.
+func TestEncoderEmbedded(t *testing.T) {
+	type Inner struct {
+		B int
+		C string
+	}
+	type Outer struct {
+		D int
+	}
+	type row struct {
+		A int
+		Inner
+		*Outer
+		E int
+	}
+
+	got := encode(t, &row{A: 1, Inner: Inner{B: 2, C: "c"}, Outer: &Outer{D: 4}, E: 5})
+	checkValues(t, got, []record.Value{intValue(1), intValue(2), textValue("c"), intValue(4), intValue(5)})
+
+	got = encode(t, &row{A: 1, Inner: Inner{B: 2, C: "c"}, E: 5})
+	checkValues(t, got, []record.Value{intValue(1), intValue(2), textValue("c"), nullValue, intValue(5)})
+}
+
+// TestEncoderKinds checks that every supported kind is stored as the value it holds.
+func TestEncoderKinds(t *testing.T) {
+	type row struct {
+		Bool    bool
+		Int     int
+		Int8    int8
+		Int16   int16
+		Int32   int32
+		Int64   int64
+		Uint    uint
+		Uint8   uint8
+		Uint16  uint16
+		Uint32  uint32
+		Uint64  uint64
+		Uintptr uintptr
+		Float32 float32
+		Float64 float64
+		String  string
+		Bytes   []byte
+		NilByte []byte
+		Ptr     *int
+		NilPtr  *string
+		PtrPtr  **float64
+	}
+
+	n := 7
+	f := 2.5
+	pf := &f
+	got := encode(t, &row{
+		Bool: true, Int: -1, Int8: math.MinInt8, Int16: math.MaxInt16, Int32: math.MinInt32, Int64: math.MaxInt64,
+		Uint: 1, Uint8: math.MaxUint8, Uint16: math.MaxUint16, Uint32: math.MaxUint32, Uint64: math.MaxInt64, Uintptr: 3,
+		Float32: 0.5, Float64: -1e300, String: "text", Bytes: []byte{0, 1}, Ptr: &n, PtrPtr: &pf,
+	})
+	checkValues(t, got, []record.Value{
+		intValue(1), intValue(-1), intValue(math.MinInt8), intValue(math.MaxInt16), intValue(math.MinInt32), intValue(math.MaxInt64),
+		intValue(1), intValue(math.MaxUint8), intValue(math.MaxUint16), intValue(math.MaxUint32), intValue(math.MaxInt64), intValue(3),
+		floatValue(0.5), floatValue(-1e300), textValue("text"), {Kind: record.Blob, Bytes: []byte{0, 1}}, nullValue,
+		intValue(7), nullValue, floatValue(2.5),
+	})
+
+	type unsupported struct {
+		M map[string]int
+	}
+	if _, err := record.NewEncoder[unsupported](); err == nil {
+		t.Error("NewEncoder with a map field: no error")
+	}
+	if _, err := record.NewEncoder[int](); err == nil {
+		t.Error("NewEncoder[int]: no error")
+	}
+}
+
+// TestEncoderAffinity checks that values are converted to the declared type's affinity,
+// as SQLite would convert them on insert.
+func TestEncoderAffinity(t *testing.T) {
+	type row struct {
+		Real      float64
+		SmallReal float64
+		NaN       float64
+		IntText   int     `rawlite:",TEXT"`
+		BoolText  bool    `rawlite:",TEXT"`
+		FloatText float64 `rawlite:",TEXT"`
+		IntReal   int64   `rawlite:",REAL"`
+		StringInt string  `rawlite:",INTEGER"`
+		StringNum string  `rawlite:",NUMERIC"`
+		FloatInt  float64 `rawlite:",INTEGER"`
+		JSONNum   int     `rawlite:",NUMERIC,json"`
+	}
+
+	got := encode(t, &row{
+		Real: 1 << 50, SmallReal: 12, NaN: math.NaN(),
+		IntText: 42, BoolText: true, FloatText: 1.5, IntReal: 1 << 50,
+		StringInt: " 12 ", StringNum: "abc", FloatInt: 3, JSONNum: 5,
+	})
+	checkValues(t, got, []record.Value{
+		floatValue(1 << 50), intValue(12), nullValue,
+		textValue("42"), textValue("1"), textValue("1.5"), floatValue(1 << 50),
+		intValue(12), textValue("abc"), intValue(3), intValue(5),
+	})
+}
+
+// TestEncoderRowid checks that an INTEGER PRIMARY KEY field is stored as NULL
+// and returned by Rowid.
+func TestEncoderRowid(t *testing.T) {
+	type row struct {
+		ID   int64 `rawlite:"id,INTEGER PRIMARY KEY"`
+		Name string
+	}
+	enc, err := record.NewEncoder[row]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &row{ID: 42, Name: "x"}
+	if rowid, ok := enc.Rowid(v); !ok || rowid != 42 {
+		t.Errorf("Rowid: got %d, %v, want 42, true", rowid, ok)
+	}
+	checkValues(t, encode(t, v), []record.Value{nullValue, textValue("x")})
+
+	type ptrRow struct {
+		ID *int `rawlite:",integer primary key"`
+	}
+	ptrEnc, err := record.NewEncoder[ptrRow]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ptrEnc.Rowid(&ptrRow{}); ok {
+		t.Error("Rowid with a nil pointer: ok")
+	}
+
+	type noRowid struct {
+		ID int64 `rawlite:",INTEGER"`
+	}
+	noEnc, err := record.NewEncoder[noRowid]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := noEnc.Rowid(&noRowid{ID: 1}); ok {
+		t.Error("Rowid without an INTEGER PRIMARY KEY: ok")
+	}
+
+	type stringRowid struct {
+		ID string `rawlite:",INTEGER PRIMARY KEY"`
+	}
+	if _, err := record.NewEncoder[stringRowid](); err == nil {
+		t.Error("NewEncoder with a string INTEGER PRIMARY KEY: no error")
+	}
+	type twoRowids struct {
+		A int `rawlite:",INTEGER PRIMARY KEY"`
+		B int `rawlite:",INTEGER PRIMARY KEY"`
+	}
+	if _, err := record.NewEncoder[twoRowids](); err == nil {
+		t.Error("NewEncoder with two INTEGER PRIMARY KEYs: no error")
+	}
+}
+
+// TestEncoderSQLite writes rows with an Encoder and its CreateTableSQL,
+// and checks that sqlite3 reads back the same values and types that it would have stored itself.
+func TestEncoderSQLite(t *testing.T) {
+	sqlite3, err := exec.LookPath("sqlite3")
+	if err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	type Embedded struct {
+		Note *string `rawlite:"note"`
+	}
+	type row struct {
+		ID    int64    `rawlite:"id,INTEGER PRIMARY KEY"`
+		Name  string   `json:"name"`
+		Score float64  `rawlite:"score,type:REAL NOT NULL"`
+		Price string   `rawlite:"price,DECIMAL(10,2)"`
+		Tags  []string `rawlite:"tags,json"`
+		Data  []byte   `rawlite:"data"`
+		*Embedded
+	}
+	enc, err := record.NewEncoder[row]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := "n"
+	rows := []row{
+		{ID: 10, Name: "a", Score: 1 << 50, Price: "1.50", Tags: []string{"x"}, Data: []byte{1}, Embedded: &Embedded{Note: &note}},
+		{ID: 20, Name: "b", Score: 2, Price: "abc", Embedded: &Embedded{}},
+		{ID: 30, Name: "c", Score: 0.5, Price: "7"},
+	}
+
+	name := filepath.Join(t.TempDir(), "test.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	db := rawlite.OpenDatabase(f)
+	tbl := db.OpenTable()
+	s, err := tbl.OpenStreamRange(1, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec record.Record
+	for i := range rows {
+		rec.Reset()
+		if err := enc.Append(&rec, &rows[i]); err != nil {
+			t.Fatal(err)
+		}
+		rowid, ok := enc.Rowid(&rows[i])
+		if !ok {
+			t.Fatal("Rowid: not ok")
+		}
+		if err := s.WriteRowWithID(rowid, rec.AppendTo(nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", enc.CreateTableSQL("t")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert the same rows with SQLite, so the two tables should be identical.
+	const sql = `PRAGMA integrity_check;
+CREATE TABLE u AS SELECT * FROM t WHERE 0;
+INSERT INTO u VALUES
+	(10, 'a', 1125899906842624, '1.50', '["x"]', x'01', 'n'),
+	(20, 'b', 2, 'abc', 'null', NULL, NULL),
+	(30, 'c', 0.5, '7', 'null', NULL, NULL);
+SELECT count(*) FROM (SELECT * FROM t EXCEPT SELECT * FROM u);
+SELECT id, name, typeof(score), score, typeof(price), price, tags, hex(data), quote(note) FROM t;
+SELECT count(*) FROM t, u
+	WHERE t.id = u.id AND typeof(t.score) = typeof(u.score) AND typeof(t.price) = typeof(u.price);`
+	out, err := exec.Command(sqlite3, name, sql).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sqlite3: %s %v", out, err)
+	}
+	want := `ok
+0
+10|a|real|1.12589990684262e+15|real|1.5|["x"]|01|'n'
+20|b|real|2.0|text|abc|null||NULL
+30|c|real|0.5|integer|7|null||NULL
+3`
+	if got := string(bytes.TrimSpace(out)); got != want {
+		t.Errorf("sqlite3 output:\n%s\nwant:\n%s", got, want)
+	}
+}
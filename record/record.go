@@ -20,7 +20,6 @@ func headerLenLen(l int) int {
 type Record struct {
 	header  []byte
 	payload []byte
-	offset  int
 }
 
 func (record *Record) AppendBlob(b []byte) {
@@ -36,6 +35,11 @@ func (record *Record) AppendBool(b bool) {
 	}
 }
 
+// AppendFloat stores integral values of f as integers,
+// as SQLite does in columns with NUMERIC or INTEGER affinity.
+// In columns with REAL affinity, SQLite stores integral values as integers
+// only if they fit in 6 bytes, and larger ones as reals;
+// use AppendFloatAs for those columns and columns with other affinities.
 func (record *Record) AppendFloat(f float64) {
 	if i := int64(f); f == float64(i) {
 		record.AppendInt(i)
@@ -134,5 +138,4 @@ func (record *Record) AppendTo(p []byte) []byte {
 func (record *Record) Reset() {
 	record.header = record.header[:0]
 	record.payload = record.payload[:0]
-	record.offset = 0
 }
@@ -0,0 +1,125 @@
+package record_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jordanwade90/rawlite/internal/svarint"
+	"github.com/jordanwade90/rawlite/record"
+	"math"
+	"strings"
+	"testing"
+)
+
+// serialTypeCases appends values of every serial type,
+// with the serial type and the Value each should decode to.
+var serialTypeCases = []struct {
+	name       string
+	append     func(rec *record.Record)
+	serialType uint64
+	want       record.Value
+}{
+	{"null", func(rec *record.Record) { rec.AppendNull() }, 0, record.Value{Kind: record.Null}},
+	{"int 2", func(rec *record.Record) { rec.AppendInt(2) }, 1, record.Value{Kind: record.Int, Int: 2}},
+	{"int -1", func(rec *record.Record) { rec.AppendInt(-1) }, 1, record.Value{Kind: record.Int, Int: -1}},
+	{"int 127", func(rec *record.Record) { rec.AppendInt(0x7f) }, 1, record.Value{Kind: record.Int, Int: 0x7f}},
+	{"int -128", func(rec *record.Record) { rec.AppendInt(-0x80) }, 1, record.Value{Kind: record.Int, Int: -0x80}},
+	{"int 128", func(rec *record.Record) { rec.AppendInt(0x80) }, 2, record.Value{Kind: record.Int, Int: 0x80}},
+	{"int -129", func(rec *record.Record) { rec.AppendInt(-0x81) }, 2, record.Value{Kind: record.Int, Int: -0x81}},
+	{"int 16 bits", func(rec *record.Record) { rec.AppendInt(-0x8000) }, 2, record.Value{Kind: record.Int, Int: -0x8000}},
+	{"int 24 bits", func(rec *record.Record) { rec.AppendInt(0x8000) }, 3, record.Value{Kind: record.Int, Int: 0x8000}},
+	{"int 24 bits negative", func(rec *record.Record) { rec.AppendInt(-0x80_0000) }, 3, record.Value{Kind: record.Int, Int: -0x80_0000}},
+	{"int 32 bits", func(rec *record.Record) { rec.AppendInt(0x80_0000) }, 4, record.Value{Kind: record.Int, Int: 0x80_0000}},
+	{"int 32 bits negative", func(rec *record.Record) { rec.AppendInt(math.MinInt32) }, 4, record.Value{Kind: record.Int, Int: math.MinInt32}},
+	{"int 48 bits", func(rec *record.Record) { rec.AppendInt(math.MaxInt32 + 1) }, 5, record.Value{Kind: record.Int, Int: math.MaxInt32 + 1}},
+	{"int 48 bits negative", func(rec *record.Record) { rec.AppendInt(-0x8000_0000_0000) }, 5, record.Value{Kind: record.Int, Int: -0x8000_0000_0000}},
+	{"int 64 bits", func(rec *record.Record) { rec.AppendInt(0x8000_0000_0000) }, 6, record.Value{Kind: record.Int, Int: 0x8000_0000_0000}},
+	{"int max", func(rec *record.Record) { rec.AppendInt(math.MaxInt64) }, 6, record.Value{Kind: record.Int, Int: math.MaxInt64}},
+	{"int min", func(rec *record.Record) { rec.AppendInt(math.MinInt64) }, 6, record.Value{Kind: record.Int, Int: math.MinInt64}},
+	{"uint 48 bits", func(rec *record.Record) { rec.AppendUint(0x7fff_ffff_ffff) }, 5, record.Value{Kind: record.Int, Int: 0x7fff_ffff_ffff}},
+	{"uint max", func(rec *record.Record) { rec.AppendUint(math.MaxInt64) }, 6, record.Value{Kind: record.Int, Int: math.MaxInt64}},
+	{"float", func(rec *record.Record) { rec.AppendFloat(1.5) }, 7, record.Value{Kind: record.Float, Float: 1.5}},
+	{"float negative", func(rec *record.Record) { rec.AppendFloat(-1e300) }, 7, record.Value{Kind: record.Float, Float: -1e300}},
+	{"integral float", func(rec *record.Record) { rec.AppendFloat(300) }, 2, record.Value{Kind: record.Int, Int: 300}},
+	{"int 0", func(rec *record.Record) { rec.AppendInt(0) }, 8, record.Value{Kind: record.Int, Int: 0}},
+	{"int 1", func(rec *record.Record) { rec.AppendInt(1) }, 9, record.Value{Kind: record.Int, Int: 1}},
+	{"uint 0", func(rec *record.Record) { rec.AppendUint(0) }, 8, record.Value{Kind: record.Int, Int: 0}},
+	{"false", func(rec *record.Record) { rec.AppendBool(false) }, 8, record.Value{Kind: record.Int, Int: 0}},
+	{"true", func(rec *record.Record) { rec.AppendBool(true) }, 9, record.Value{Kind: record.Int, Int: 1}},
+	{"empty blob", func(rec *record.Record) { rec.AppendBlob([]byte{}) }, 12, record.Value{Kind: record.Blob, Bytes: []byte{}}},
+	{"blob", func(rec *record.Record) { rec.AppendBlob([]byte{0, 1, 2}) }, 18, record.Value{Kind: record.Blob, Bytes: []byte{0, 1, 2}}},
+	{"empty text", func(rec *record.Record) { rec.AppendString("") }, 13, record.Value{Kind: record.Text, Bytes: []byte{}}},
+	{"text", func(rec *record.Record) { rec.AppendString("abc") }, 19, record.Value{Kind: record.Text, Bytes: []byte("abc")}},
+	{"text slice", func(rec *record.Record) { rec.AppendStringSlice([]byte("abc")) }, 19, record.Value{Kind: record.Text, Bytes: []byte("abc")}},
+	{"json", func(rec *record.Record) { rec.AppendJSON(map[string]int{"a": 1}) }, 13 + 2*7, record.Value{Kind: record.Text, Bytes: []byte(`{"a":1}`)}},
+	// Values too large for any page, stored in overflow pages.
+	{"large blob", func(rec *record.Record) { rec.AppendBlob(bytes.Repeat([]byte{0xff}, 100000)) }, 12 + 2*100000, record.Value{Kind: record.Blob, Bytes: bytes.Repeat([]byte{0xff}, 100000)}},
+	{"large text", func(rec *record.Record) { rec.AppendString(strings.Repeat("x", 1<<20)) }, 13 + 2<<20, record.Value{Kind: record.Text, Bytes: []byte(strings.Repeat("x", 1<<20))}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, tc := range serialTypeCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var rec record.Record
+			tc.append(&rec)
+			p := rec.AppendTo(nil)
+
+			_, n := svarint.Get(p)
+			if serialType, _ := svarint.Get(p[n:]); serialType != tc.serialType {
+				t.Errorf("serial type %d, want %d", serialType, tc.serialType)
+			}
+			values, err := record.Decode(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != 1 || !equal(values[0], tc.want) {
+				t.Errorf("decoded %v, want %v", values, tc.want)
+			}
+		})
+	}
+}
+
+// TestRoundTripColumns checks a record with every serial type in it several times,
+// so that its header is too long for a one-byte size.
+func TestRoundTripColumns(t *testing.T) {
+	var rec record.Record
+	var want []record.Value
+	for range 10 {
+		for _, tc := range serialTypeCases {
+			tc.append(&rec)
+			want = append(want, tc.want)
+		}
+	}
+	p := rec.AppendTo(nil)
+	if headerSize, n := svarint.Get(p); n < 2 {
+		t.Fatalf("header size %d fits in one byte", headerSize)
+	}
+
+	values, err := record.Decode(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != len(want) {
+		t.Fatalf("decoded %d values, want %d", len(values), len(want))
+	}
+	for i := range want {
+		if !equal(values[i], want[i]) {
+			t.Errorf("column %d: decoded %v, want %v", i, values[i], want[i])
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	var rec record.Record
+	rec.AppendInt(1000)
+	rec.AppendString("abc")
+	p := rec.AppendTo(nil)
+	for n := range len(p) {
+		if _, err := record.Decode(p[:n]); !errors.Is(err, record.ErrMalformed) {
+			t.Errorf("truncated to %d bytes: got %v, want ErrMalformed", n, err)
+		}
+	}
+}
+
+func equal(a, b record.Value) bool {
+	return a.Kind == b.Kind && a.Int == b.Int && a.Float == b.Float && bytes.Equal(a.Bytes, b.Bytes)
+}
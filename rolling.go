@@ -0,0 +1,440 @@
+package rawlite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"sync"
+)
+
+// rollingMargin is how many pages short of SQLite's maximum page count
+// a part of a RollingDatabase is considered full,
+// leaving room for the streams still writing to it.
+const rollingMargin = 1 << 20
+
+// RollingDatabase writes the rows of its tables to a sequence of Databases, called parts,
+// moving on to a new part whenever the current one reaches a maximum size.
+// Every part has the same tables.
+// The rowids of each table are unique across all the parts,
+// and increase from one part to the next,
+// so the manifest can say which part holds a given rowid.
+//
+// If any part fails, every part fails with the same error.
+type RollingDatabase struct {
+	create    func(part int) (io.WriterAt, error)
+	open      func(file io.WriterAt) *Database
+	maxPages  uint32
+	rowidSpan int64
+
+	// lock protects tables, parts, current, closed, err, and manifest.
+	lock   sync.Mutex
+	tables []*RollingTable
+	parts  []*rollingPart
+	// current is the part new streams write to, or nil before the first part is created.
+	current *rollingPart
+	closed  bool
+	// err is the error the RollingDatabase failed with.
+	err      error
+	manifest RollingManifest
+}
+
+// rollingPart is one part of a RollingDatabase.
+type rollingPart struct {
+	index int
+	file  io.WriterAt
+	db    *Database
+	// tables holds the part's Table for each RollingTable, by index,
+	// and info what has been written to it.
+	tables []*Table
+	info   []RollingTableInfo
+	// streams is the number of RollingTableStreams writing to the part.
+	streams  int
+	finished bool
+}
+
+// RollingManifest describes the parts of a RollingDatabase.
+type RollingManifest struct {
+	// Parts describes each finished part, in order.
+	Parts []PartInfo `json:"parts"`
+}
+
+// PartInfo describes one part of a RollingDatabase.
+type PartInfo struct {
+	// PageCount is the size of the part in pages.
+	PageCount uint32 `json:"page_count"`
+	// Tables describes the rows written to each table of the part.
+	Tables map[string]RollingTableInfo `json:"tables"`
+}
+
+// RollingTableInfo describes the rows written to one table of a part.
+type RollingTableInfo struct {
+	Rows int64 `json:"rows"`
+	// FirstRowid and LastRowid are the smallest and largest rowids in the part,
+	// or 0 if it has no rows.
+	FirstRowid int64 `json:"first_rowid"`
+	LastRowid  int64 `json:"last_rowid"`
+}
+
+// OpenRollingDatabase prepares to write a RollingDatabase,
+// calling create to create the file of each part as it is needed,
+// with parts numbered from 0.
+// The options apply to every part.
+//
+// A part is full once it has maxSize bytes of pages,
+// but the streams writing to it may each add a row as they move to the next part,
+// and closing its tables adds the last interior pages of their B-trees.
+// If maxSize is 0 or more than SQLite allows,
+// parts are only limited by SQLite's maximum page count.
+//
+// A part is finished once every stream has moved on from it.
+// If its file implements io.Closer, it is closed then.
+// If maxSize is negative, or an option is invalid,
+// the RollingDatabase fails with an error wrapping ErrInvalidOption.
+func OpenRollingDatabase(create func(part int) (io.WriterAt, error), maxSize int64, opts ...DatabaseOption) *RollingDatabase {
+	return openRollingDatabase(create, maxSize, opts, func(file io.WriterAt) *Database {
+		return OpenDatabase(file, opts...)
+	})
+}
+
+// OpenRollingDatabaseContext is like OpenRollingDatabase,
+// but if ctx is canceled before Close every part fails with the context's cause.
+func OpenRollingDatabaseContext(ctx context.Context, create func(part int) (io.WriterAt, error), maxSize int64, opts ...DatabaseOption) *RollingDatabase {
+	return openRollingDatabase(create, maxSize, opts, func(file io.WriterAt) *Database {
+		return OpenDatabaseContext(ctx, file, opts...)
+	})
+}
+
+func openRollingDatabase(create func(int) (io.WriterAt, error), maxSize int64, opts []DatabaseOption, open func(io.WriterAt) *Database) *RollingDatabase {
+	// Only the page size of this Database is used; nothing is written to it.
+	probe := OpenDatabase(nil, opts...)
+	rdb := &RollingDatabase{
+		create:    create,
+		open:      open,
+		maxPages:  maxPageCount - rollingMargin,
+		rowidSpan: (maxPageCount + 1) * probe.maxRowsPerPage(),
+		err:       probe.Err(),
+	}
+	if maxSize < 0 {
+		rdb.fail(fmt.Errorf("%w: negative maximum size %d", ErrInvalidOption, maxSize))
+	}
+	if maxPages := maxSize / int64(probe.pageSize); maxSize != 0 && maxPages < int64(rdb.maxPages) {
+		rdb.maxPages = uint32(max(maxPages, 1))
+	}
+	return rdb
+}
+
+// full returns whether the part has reached the maximum size.
+func (p *rollingPart) full(maxPages uint32) bool {
+	return p.db.nextPageNumber.Load()-1 >= maxPages
+}
+
+// nextPart creates a new part and makes it the current part.
+// If the old part has no streams left, it returns it so the caller can finish it
+// without holding lock.
+// The caller must hold lock.
+func (rdb *RollingDatabase) nextPart() (finish *rollingPart, err error) {
+	index := len(rdb.parts)
+	if int64(index) > math.MaxInt64/rdb.rowidSpan-1 {
+		return nil, rdb.failLocked(errors.New("too many parts"))
+	}
+	file, err := rdb.create(index)
+	if err != nil {
+		return nil, rdb.failLocked(err)
+	}
+
+	part := &rollingPart{index: index, file: file, db: rdb.open(file)}
+	for _, tbl := range rdb.tables {
+		part.openTable(tbl, rdb.rowidSpan)
+	}
+	if old := rdb.current; old != nil && old.streams == 0 {
+		finish = old
+	}
+	rdb.parts = append(rdb.parts, part)
+	rdb.current = part
+	return finish, nil
+}
+
+// openTable opens the part's Table for tbl.
+func (p *rollingPart) openTable(tbl *RollingTable, rowidSpan int64) *Table {
+	t := p.db.OpenTable(tbl.opts...)
+	t.rowidBase = int64(p.index) * rowidSpan
+	p.tables = append(p.tables, t)
+	p.info = append(p.info, RollingTableInfo{})
+	return t
+}
+
+// finish closes every table of the part and the part itself,
+// and adds it to the manifest.
+func (rdb *RollingDatabase) finish(part *rollingPart) {
+	rdb.lock.Lock()
+	part.finished = true
+	tables := rdb.tables
+	for len(part.tables) < len(tables) {
+		// The table was opened after the part was created.
+		part.openTable(tables[len(part.tables)], rdb.rowidSpan)
+	}
+	rdb.lock.Unlock()
+
+	var err error
+	for i, tbl := range tables {
+		if closeErr := part.tables[i].Close(tbl.name, tbl.sql); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := part.db.Close(); err == nil {
+		err = closeErr
+	}
+	if c, ok := part.file.(io.Closer); ok {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	rdb.lock.Lock()
+	defer rdb.lock.Unlock()
+	if err != nil {
+		rdb.failLocked(err)
+		return
+	}
+	info := PartInfo{PageCount: part.db.Header().PageCount, Tables: make(map[string]RollingTableInfo)}
+	for i, tbl := range tables {
+		info.Tables[tbl.name] = part.info[i]
+	}
+	for len(rdb.manifest.Parts) <= part.index {
+		rdb.manifest.Parts = append(rdb.manifest.Parts, PartInfo{})
+	}
+	rdb.manifest.Parts[part.index] = info
+}
+
+// fail makes every part fail with err, unless the RollingDatabase has already failed,
+// and returns the error it failed with.
+func (rdb *RollingDatabase) fail(err error) error {
+	rdb.lock.Lock()
+	defer rdb.lock.Unlock()
+
+	return rdb.failLocked(err)
+}
+
+// failLocked is like fail, but the caller must hold lock.
+func (rdb *RollingDatabase) failLocked(err error) error {
+	if rdb.err == nil {
+		rdb.err = err
+		for _, part := range rdb.parts {
+			if !part.finished {
+				part.db.fail(err)
+			}
+		}
+	}
+	return rdb.err
+}
+
+// Err returns the error the RollingDatabase failed with, or nil if it hasn't failed.
+func (rdb *RollingDatabase) Err() error {
+	rdb.lock.Lock()
+	defer rdb.lock.Unlock()
+
+	return rdb.err
+}
+
+// Close finishes the current part, creating it if no rows were written,
+// and returns the error the RollingDatabase failed with, if any.
+// All RollingTableStreams must be closed before calling Close.
+func (rdb *RollingDatabase) Close() error {
+	rdb.lock.Lock()
+	if rdb.closed {
+		rdb.lock.Unlock()
+		return ErrClosed
+	}
+	rdb.closed = true
+	if rdb.current == nil && rdb.err == nil {
+		rdb.nextPart()
+	}
+	part := rdb.current
+	rdb.lock.Unlock()
+
+	if part != nil {
+		rdb.finish(part)
+	}
+	return rdb.Err()
+}
+
+// Manifest returns the manifest describing the RollingDatabase,
+// which is complete once it has been closed.
+func (rdb *RollingDatabase) Manifest() RollingManifest {
+	rdb.lock.Lock()
+	defer rdb.lock.Unlock()
+
+	var m RollingManifest
+	for _, part := range rdb.manifest.Parts {
+		m.Parts = append(m.Parts, PartInfo{PageCount: part.PageCount, Tables: maps.Clone(part.Tables)})
+	}
+	return m
+}
+
+// WriteManifest writes the manifest describing the RollingDatabase to w as JSON.
+func (rdb *RollingDatabase) WriteManifest(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(rdb.Manifest())
+}
+
+// OpenTable opens a table, which is created in every part with the given name and CREATE TABLE statement.
+// Tables should be opened before writing any rows;
+// a table opened later is missing from the parts finished before.
+// The DenseRowids option cannot be used;
+// if it is, the RollingDatabase fails with an error wrapping ErrInvalidOption.
+// So does any other option that would make a part fail.
+func (rdb *RollingDatabase) OpenTable(name, sql string, opts ...TableOption) *RollingTable {
+	// Apply the options now, rather than when the table is opened in a part,
+	// so that an invalid option fails the RollingDatabase before any rows are written.
+	// TableOptions only set fields of the Table or fail its Database,
+	// so a Table of a Database with no file is enough to see what they do.
+	probe := &Table{parent: &Database{}}
+	for _, opt := range opts {
+		opt(probe)
+	}
+
+	rdb.lock.Lock()
+	defer rdb.lock.Unlock()
+
+	if err := probe.parent.Err(); err != nil {
+		rdb.failLocked(err)
+	} else if probe.denseRowids {
+		rdb.failLocked(fmt.Errorf("%w: DenseRowids cannot be used with a RollingDatabase", ErrInvalidOption))
+	}
+
+	tbl := &RollingTable{parent: rdb, index: len(rdb.tables), name: name, sql: sql, opts: opts}
+	rdb.tables = append(rdb.tables, tbl)
+	if rdb.current != nil && !rdb.current.finished {
+		rdb.current.openTable(tbl, rdb.rowidSpan)
+	}
+	return tbl
+}
+
+// RollingTable represents a table being created in every part of a RollingDatabase.
+// It is closed in each part as the part is finished.
+type RollingTable struct {
+	parent    *RollingDatabase
+	index     int
+	name, sql string
+	opts      []TableOption
+}
+
+// OpenStream opens a RollingTableStream for writing to this table.
+// The stream assigns rowids automatically.
+func (tbl *RollingTable) OpenStream() *RollingTableStream {
+	return &RollingTableStream{parent: tbl}
+}
+
+// RollingTableStream represents one stream of data being written to a RollingTable.
+// RollingTableStreams are not thread-safe; open one RollingTableStream per worker goroutine.
+type RollingTableStream struct {
+	parent *RollingTable
+	// part is the part the stream is writing to, or nil before the first row.
+	part   *rollingPart
+	stream *TableStream
+	// info describes the rows written to part.
+	info RollingTableInfo
+}
+
+// WriteRow writes one row to the current part,
+// returning the part and the rowid the row was assigned.
+// Like TableStream.WriteRow, it does not retain row.
+func (s *RollingTableStream) WriteRow(row []byte) (part int, rowid int64, err error) {
+	rdb := s.parent.parent
+	if s.part == nil || s.part.full(rdb.maxPages) {
+		if err := s.roll(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	rowid, err = s.stream.WriteRow(row)
+	if err != nil {
+		if s.part.db.check() != nil {
+			err = rdb.fail(s.part.db.Err())
+		}
+		return 0, 0, err
+	}
+	if s.info.Rows == 0 {
+		s.info.FirstRowid = rowid
+	}
+	s.info.LastRowid = rowid
+	s.info.Rows++
+	return s.part.index, rowid, nil
+}
+
+// roll moves the stream to the current part,
+// or to a new part if the current part is full.
+func (s *RollingTableStream) roll() error {
+	rdb := s.parent.parent
+	rdb.lock.Lock()
+	if rdb.err != nil {
+		rdb.lock.Unlock()
+		return rdb.err
+	}
+	if rdb.closed {
+		rdb.lock.Unlock()
+		return ErrClosed
+	}
+	var finish *rollingPart
+	if rdb.current == nil || rdb.current.full(rdb.maxPages) {
+		var err error
+		if finish, err = rdb.nextPart(); err != nil {
+			rdb.lock.Unlock()
+			return err
+		}
+	}
+	part := rdb.current
+	part.streams++
+	stream := part.tables[s.parent.index].OpenStream()
+	rdb.lock.Unlock()
+
+	if finish != nil {
+		rdb.finish(finish)
+	}
+	err := s.leave()
+	s.part, s.stream = part, stream
+	return err
+}
+
+// leave closes the stream on its part,
+// finishing the part if it is full and this was its last stream.
+func (s *RollingTableStream) leave() error {
+	if s.part == nil {
+		return nil
+	}
+	rdb := s.parent.parent
+	err := s.stream.Close()
+	if err != nil && s.part.db.check() != nil {
+		err = rdb.fail(s.part.db.Err())
+	}
+
+	rdb.lock.Lock()
+	part := s.part
+	part.streams--
+	info := &part.info[s.parent.index]
+	if s.info.Rows != 0 {
+		if info.Rows == 0 || s.info.FirstRowid < info.FirstRowid {
+			info.FirstRowid = s.info.FirstRowid
+		}
+		info.LastRowid = max(info.LastRowid, s.info.LastRowid)
+		info.Rows += s.info.Rows
+	}
+	finish := part.streams == 0 && part != rdb.current
+	rdb.lock.Unlock()
+
+	s.part, s.stream, s.info = nil, nil, RollingTableInfo{}
+	if finish {
+		rdb.finish(part)
+	}
+	return err
+}
+
+// Close closes the stream on the part it is writing to.
+func (s *RollingTableStream) Close() error {
+	return s.leave()
+}
@@ -0,0 +1,192 @@
+package rawlite_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"io"
+	"sync"
+	"testing"
+)
+
+// TestRollingDatabase checks that rows written by several streams are spread over several parts,
+// each a valid database, and that the manifest describes the rows of each part.
+func TestRollingDatabase(t *testing.T) {
+	const pageSize, maxPages, streams, rows = 512, 64, 4, 1000
+	var files []*memFile
+	create := func(part int) (io.WriterAt, error) {
+		if part != len(files) {
+			t.Errorf("created part %d after %d parts", part, len(files))
+		}
+		files = append(files, &memFile{})
+		return files[len(files)-1], nil
+	}
+	rdb := rawlite.OpenRollingDatabase(create, maxPages*pageSize, rawlite.PageSize(pageSize))
+	tbl := rdb.OpenTable("t", "CREATE TABLE t(a, b)")
+
+	// written holds the part and rowid WriteRow returned for each row.
+	written := make([][][2]int64, streams)
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := tbl.OpenStream()
+			for j := range rows {
+				part, rowid, err := s.WriteRow(overflowRow(i*rows + j))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				written[i] = append(written[i], [2]int64{int64(part), rowid})
+			}
+			if err := s.Close(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := rdb.Manifest()
+	if len(m.Parts) != len(files) || len(files) < 2 {
+		t.Fatalf("manifest has %d parts for %d files, want at least 2", len(m.Parts), len(files))
+	}
+	total := int64(0)
+	for i, part := range m.Parts {
+		f := files[i]
+		checkDatabase(t, f)
+		if int(part.PageCount)*pageSize != len(f.data) || part.PageCount > 2*maxPages {
+			t.Errorf("part %d: page count %d for %d bytes, limit %d pages", i, part.PageCount, len(f.data), maxPages)
+		}
+		info := part.Tables["t"]
+		total += info.Rows
+		if i > 0 && m.Parts[i-1].Tables["t"].LastRowid >= info.FirstRowid {
+			t.Errorf("part %d: first rowid %d isn't greater than the last rowid of the part before", i, info.FirstRowid)
+		}
+		want := fmt.Sprintf("%d|%d|%d", info.Rows, info.FirstRowid, info.LastRowid)
+		if got := querySQLite(t, f, "SELECT count(*), min(rowid), max(rowid) FROM t"); got != want {
+			t.Errorf("part %d: got count, min, and max rowid %s, want %s from the manifest", i, got, want)
+		}
+	}
+	if total != streams*rows {
+		t.Errorf("manifest has %d rows, want %d", total, streams*rows)
+	}
+	for _, rows := range written {
+		for _, w := range rows {
+			info := m.Parts[w[0]].Tables["t"]
+			if w[1] < info.FirstRowid || w[1] > info.LastRowid {
+				t.Fatalf("rowid %d in part %d, outside its range %d to %d", w[1], w[0], info.FirstRowid, info.LastRowid)
+			}
+		}
+	}
+}
+
+// TestRollingDatabaseNoRows checks that closing a RollingDatabase with no rows
+// creates one part with empty tables.
+func TestRollingDatabaseNoRows(t *testing.T) {
+	var files []*memFile
+	create := func(part int) (io.WriterAt, error) {
+		files = append(files, &memFile{})
+		return files[len(files)-1], nil
+	}
+	rdb := rawlite.OpenRollingDatabase(create, 0, rawlite.PageSize(512))
+	rdb.OpenTable("t", "CREATE TABLE t(a)")
+	rdb.OpenTable("u", "CREATE TABLE u(a)")
+	if err := rdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := rdb.Manifest()
+	if len(files) != 1 || len(m.Parts) != 1 {
+		t.Fatalf("got %d files and %d parts in the manifest, want 1", len(files), len(m.Parts))
+	}
+	for _, name := range []string{"t", "u"} {
+		if info := m.Parts[0].Tables[name]; info != (rawlite.RollingTableInfo{}) {
+			t.Errorf("table %s: got %+v, want no rows", name, info)
+		}
+	}
+	checkDatabase(t, files[0])
+	if got := querySQLite(t, files[0], "SELECT (SELECT count(*) FROM t) + (SELECT count(*) FROM u)"); got != "0" {
+		t.Errorf("got %s rows, want 0", got)
+	}
+}
+
+// TestRollingDatabaseFailure checks that a part that fails makes every unfinished part fail,
+// so none of them gets a database header.
+func TestRollingDatabaseFailure(t *testing.T) {
+	var files []*memFile
+	create := func(part int) (io.WriterAt, error) {
+		if part == 2 {
+			return failingFile{}, nil
+		}
+		files = append(files, &memFile{})
+		return files[len(files)-1], nil
+	}
+	rdb := rawlite.OpenRollingDatabase(create, 16*512, rawlite.PageSize(512))
+	tbl := rdb.OpenTable("t", "CREATE TABLE t(a, b)")
+
+	// idle stays on part 0 while busy moves on to the failing part.
+	idle := tbl.OpenStream()
+	if _, _, err := idle.WriteRow(overflowRow(0)); err != nil {
+		t.Fatal(err)
+	}
+	busy := tbl.OpenStream()
+	var err error
+	for i := 0; err == nil && i < 10000; i++ {
+		_, _, err = busy.WriteRow(overflowRow(i))
+	}
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("writing to the failing part: got %v, want errWrite", err)
+	}
+	if _, _, err := busy.WriteRow(overflowRow(0)); !errors.Is(err, errWrite) {
+		t.Errorf("writing after the failure: got %v, want errWrite", err)
+	}
+
+	if err := idle.Close(); !errors.Is(err, errWrite) {
+		t.Errorf("closing the stream on part 0: got %v, want errWrite", err)
+	}
+	busy.Close()
+	if err := rdb.Close(); !errors.Is(err, errWrite) {
+		t.Errorf("Close: got %v, want errWrite", err)
+	}
+	if !bytes.HasPrefix(files[1].data, []byte("SQLite format 3\x00")) {
+		t.Error("part 1, finished before the failure, has no header")
+	}
+	if bytes.HasPrefix(files[0].data, []byte("SQLite format 3\x00")) {
+		t.Error("part 0 has a header")
+	}
+}
+
+// TestRollingDatabaseInvalidOptions checks that invalid options make the RollingDatabase fail
+// before any part is created.
+func TestRollingDatabaseInvalidOptions(t *testing.T) {
+	create := func(part int) (io.WriterAt, error) {
+		t.Errorf("created part %d", part)
+		return &memFile{}, nil
+	}
+	for name, open := range map[string]func() *rawlite.RollingDatabase{
+		"negative size": func() *rawlite.RollingDatabase {
+			return rawlite.OpenRollingDatabase(create, -1)
+		},
+		"page size": func() *rawlite.RollingDatabase {
+			return rawlite.OpenRollingDatabase(create, 0, rawlite.PageSize(100))
+		},
+		"DenseRowids": func() *rawlite.RollingDatabase {
+			rdb := rawlite.OpenRollingDatabase(create, 0)
+			rdb.OpenTable("t", "CREATE TABLE t(a)", rawlite.DenseRowids())
+			return rdb
+		},
+	} {
+		rdb := open()
+		if _, _, err := rdb.OpenTable("u", "CREATE TABLE u(a)").OpenStream().WriteRow([]byte{2, 1, 1}); !errors.Is(err, rawlite.ErrInvalidOption) {
+			t.Errorf("%s: WriteRow: got %v, want ErrInvalidOption", name, err)
+		}
+		if err := rdb.Close(); !errors.Is(err, rawlite.ErrInvalidOption) {
+			t.Errorf("%s: Close: got %v, want ErrInvalidOption", name, err)
+		}
+	}
+}
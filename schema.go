@@ -0,0 +1,218 @@
+package rawlite
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"strings"
+)
+
+// Schema describes the columns of a table.
+type Schema struct {
+	Columns []Column
+	// Strict makes the table a STRICT table,
+	// whose column types must be INT, INTEGER, REAL, TEXT, BLOB, or ANY.
+	// See https://sqlite.org/stricttables.html
+	Strict bool
+}
+
+// Column describes one column of a table.
+type Column struct {
+	Name string
+	// Type is the declared type of the column, such as INTEGER or VARCHAR(20),
+	// which determines its affinity.
+	Type    string
+	NotNull bool
+	// PrimaryKey makes the column an INTEGER PRIMARY KEY,
+	// an alias for the rowid, so Type must be INTEGER.
+	// Its value is the rowid, so it is always NULL in the row itself.
+	// SQLite keeps other primary keys in a separate index,
+	// which rawlite doesn't create.
+	PrimaryKey bool
+}
+
+// CreateTableSQL returns the CREATE TABLE statement for a table named name with this schema,
+// or the error Check reports.
+func (schema *Schema) CreateTableSQL(name string) (string, error) {
+	if err := schema.Check(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString("CREATE TABLE ")
+	b.WriteString(record.QuoteIdentifier(name))
+	b.WriteString(" (")
+	for i, col := range schema.Columns {
+		if i != 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(record.QuoteIdentifier(col.Name))
+		if col.Type != "" {
+			b.WriteString(" ")
+			b.WriteString(col.Type)
+		}
+		if col.PrimaryKey {
+			b.WriteString(" PRIMARY KEY")
+		}
+		if col.NotNull {
+			b.WriteString(" NOT NULL")
+		}
+	}
+	b.WriteString(")")
+	if schema.Strict {
+		b.WriteString(" STRICT")
+	}
+	return b.String(), nil
+}
+
+// maxColumns is the most columns SQLite allows in a table by default (SQLITE_MAX_COLUMN).
+const maxColumns = 2000
+
+// Check returns an error if the schema can't describe a table rawlite writes:
+// if a column of a Strict schema has a type other than INT, INTEGER, REAL, TEXT, BLOB, or ANY,
+// if there is more than one PrimaryKey column or it doesn't have type INTEGER,
+// or, with ErrSchemaTooLarge, if there are more columns than SQLite allows.
+// CreateTableSQL returns that error, and ValidateRows makes the Database fail with it.
+func (schema *Schema) Check() error {
+	if len(schema.Columns) > maxColumns {
+		return fmt.Errorf("%w: %d columns, more than %d", ErrSchemaTooLarge, len(schema.Columns), maxColumns)
+	}
+	primaryKeys := 0
+	for _, col := range schema.Columns {
+		if schema.Strict && !isStrictType(col.Type) {
+			return fmt.Errorf("column %s: invalid type for STRICT table: %q", col.Name, col.Type)
+		}
+		if col.PrimaryKey {
+			primaryKeys++
+			if !strings.EqualFold(col.Type, "INTEGER") {
+				return fmt.Errorf("column %s: primary key column must have type INTEGER", col.Name)
+			}
+		}
+	}
+	if primaryKeys > 1 {
+		return errors.New("more than one primary key column")
+	}
+	return nil
+}
+
+// Validate checks that row, a record, matches the schema.
+// The row must have one value per column,
+// NOT NULL columns must not be NULL,
+// and the INTEGER PRIMARY KEY column, if any, must be NULL.
+// Every other value must be one that SQLite would store unchanged
+// in a column with that column's affinity;
+// see record.Affinity.Accepts.
+// In a Strict schema, every other value must instead have the column's type,
+// except that REAL columns may hold integers that fit in 6 bytes
+// and ANY columns may hold anything,
+// and a mismatch is reported with an error wrapping ErrStrictType.
+//
+// Any problem is reported as a *RowError.
+func (schema *Schema) Validate(row []byte) error {
+	var d record.Decoder
+	if err := d.Reset(row); err != nil {
+		return &RowError{Column: -1, Err: err}
+	}
+
+	for i := 0; ; i++ {
+		v, err := d.Next()
+		if err == io.EOF {
+			if i != len(schema.Columns) {
+				return &RowError{Column: -1, Err: fmt.Errorf("row has %d columns, want %d", i, len(schema.Columns))}
+			}
+			return nil
+		} else if err != nil {
+			return &RowError{Column: -1, Err: err}
+		}
+		if i >= len(schema.Columns) {
+			return &RowError{Column: -1, Err: fmt.Errorf("row has more than %d columns", len(schema.Columns))}
+		}
+
+		col := &schema.Columns[i]
+		switch {
+		case col.PrimaryKey:
+			if v.Kind != record.Null {
+				return &RowError{Column: i, Name: col.Name, Err: fmt.Errorf("INTEGER PRIMARY KEY is %v, want NULL", v.Kind)}
+			}
+		case v.Kind == record.Null:
+			if col.NotNull {
+				return &RowError{Column: i, Name: col.Name, Err: errors.New("NULL in NOT NULL column")}
+			}
+		case schema.Strict:
+			if !strictAccepts(col.Type, v) {
+				return &RowError{Column: i, Name: col.Name, Err: fmt.Errorf("%w: %v value in %s column", ErrStrictType, v.Kind, strings.ToUpper(col.Type))}
+			}
+		default:
+			if affinity := record.ColumnAffinity(col.Type); !affinity.Accepts(v) {
+				return &RowError{Column: i, Name: col.Name, Err: fmt.Errorf("%v value would be converted by %v affinity", v.Kind, affinity)}
+			}
+		}
+	}
+}
+
+// isStrictType reports whether typ is one of the types allowed in a STRICT table.
+func isStrictType(typ string) bool {
+	switch strings.ToUpper(typ) {
+	case "INT", "INTEGER", "REAL", "TEXT", "BLOB", "ANY":
+		return true
+	default:
+		return false
+	}
+}
+
+// strictAccepts reports whether a STRICT table allows
+// the non-NULL value v in a column of type typ.
+func strictAccepts(typ string, v record.Value) bool {
+	switch strings.ToUpper(typ) {
+	case "INT", "INTEGER":
+		return v.Kind == record.Int
+	case "REAL":
+		// Like any REAL column, integers that don't fit in 6 bytes are converted to reals.
+		return v.Kind == record.Float || v.Kind == record.Int && record.RealAffinity.Accepts(v)
+	case "TEXT":
+		return v.Kind == record.Text
+	case "BLOB":
+		return v.Kind == record.Blob
+	default:
+		return true
+	}
+}
+
+// ErrStrictType is wrapped by the RowError returned for a value
+// whose type doesn't match its column in a STRICT table.
+var ErrStrictType = errors.New("value does not match STRICT column type")
+
+// RowError describes a row that doesn't match the Schema of its Table.
+type RowError struct {
+	// Column is the index of the column with the problem,
+	// or -1 if the problem is with the row as a whole.
+	Column int
+	// Name is the name of the column.
+	Name string
+	Err  error
+}
+
+func (e *RowError) Error() string {
+	if e.Column < 0 {
+		return "invalid row: " + e.Err.Error()
+	}
+	return fmt.Sprintf("invalid row: column %d (%s): %v", e.Column, e.Name, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateRows makes every TableStream of the Table check each row against schema
+// before writing it, returning a *RowError from WriteRow if it doesn't match.
+// If Check reports an error, the Database fails with it.
+func ValidateRows(schema Schema) TableOption {
+	return func(tbl *Table) {
+		if err := schema.Check(); err != nil {
+			tbl.parent.fail(err)
+			return
+		}
+		tbl.schema = &schema
+	}
+}
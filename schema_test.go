@@ -0,0 +1,56 @@
+package rawlite_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"testing"
+)
+
+func TestSchemaCheck(t *testing.T) {
+	var wide rawlite.Schema
+	for i := range 2001 {
+		wide.Columns = append(wide.Columns, rawlite.Column{Name: fmt.Sprintf("c%d", i)})
+	}
+	if err := wide.Check(); !errors.Is(err, rawlite.ErrSchemaTooLarge) {
+		t.Errorf("2001 columns: got %v, want ErrSchemaTooLarge", err)
+	}
+	wide.Columns = wide.Columns[:2000]
+	if err := wide.Check(); err != nil {
+		t.Errorf("2000 columns: %v", err)
+	}
+
+	for _, schema := range []rawlite.Schema{
+		{Columns: []rawlite.Column{{Name: "a", Type: "VARCHAR(10)"}}, Strict: true},
+		{Columns: []rawlite.Column{{Name: "a", Type: "TEXT", PrimaryKey: true}}},
+		{Columns: []rawlite.Column{{Name: "a", Type: "INTEGER", PrimaryKey: true}, {Name: "b", Type: "INTEGER", PrimaryKey: true}}},
+	} {
+		if err := schema.Check(); err == nil {
+			t.Errorf("%+v: no error", schema)
+		}
+	}
+}
+
+// TestValidateStrictReal checks that a STRICT REAL column only takes integers that SQLite keeps as integers.
+func TestValidateStrictReal(t *testing.T) {
+	schema := rawlite.Schema{Columns: []rawlite.Column{{Name: "a", Type: "REAL"}}, Strict: true}
+	for _, tc := range []struct {
+		i  int64
+		ok bool
+	}{
+		{12, true},
+		{0x7fff_ffff_ffff, true},
+		{-0x8000_0000_0000, true},
+		{0x8000_0000_0000, false},
+		{-0x8000_0000_0001, false},
+	} {
+		var rec record.Record
+		rec.AppendInt(tc.i)
+		if err := schema.Validate(rec.AppendTo(nil)); (err == nil) != tc.ok {
+			t.Errorf("%d: got %v", tc.i, err)
+		} else if err != nil && !errors.Is(err, rawlite.ErrStrictType) {
+			t.Errorf("%d: got %v, want ErrStrictType", tc.i, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package rawlite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// ShardedDatabase writes the rows of its tables to several Databases, called shards,
+// choosing the shard for each row by its key.
+// Every shard has the same tables, even if some of them get no rows.
+//
+// If any shard fails, every shard fails with the same error.
+type ShardedDatabase struct {
+	shards      []*Database
+	partitioner Partitioner
+
+	// manifestLock protects manifest.
+	manifestLock sync.Mutex
+	manifest     ShardManifest
+}
+
+// A Partitioner chooses the shard of a ShardedDatabase for each row by its key.
+type Partitioner struct {
+	// Shard returns the shard, from 0 to n-1, for a row whose key is key.
+	// For any other shard, WriteRow returns an error without writing the row.
+	Shard func(key []byte, n int) int
+	// Description describes the partitioning in the manifest.
+	// It must be possible to encode it as JSON.
+	Description any
+}
+
+// HashPartitioner returns a Partitioner that assigns rows to shards
+// by the 64-bit FNV-1a hash of their keys, modulo the number of shards.
+func HashPartitioner() Partitioner {
+	return Partitioner{
+		Shard: func(key []byte, n int) int {
+			h := fnv.New64a()
+			h.Write(key)
+			return int(h.Sum64() % uint64(n))
+		},
+		Description: map[string]string{"type": "hash", "hash": "fnv1a-64"},
+	}
+}
+
+// RangePartitioner returns a Partitioner that assigns rows to shards by ranges of keys,
+// which must be used with len(bounds)+1 shards.
+// Shard i gets the keys that are at least bounds[i-1] and less than bounds[i],
+// comparing them as bytes.
+// The bounds must be in increasing order; RangePartitioner returns an error if they aren't.
+// The manifest lists them in base64, as encoding/json encodes byte slices.
+func RangePartitioner(bounds ...[]byte) (Partitioner, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bytes.Compare(bounds[i-1], bounds[i]) >= 0 {
+			return Partitioner{}, fmt.Errorf("range partitioner bounds %d and %d are not increasing", i-1, i)
+		}
+	}
+	bounds = slices.Clone(bounds)
+	return Partitioner{
+		Shard: func(key []byte, n int) int {
+			if n != len(bounds)+1 {
+				// Used with the wrong number of shards.
+				return -1
+			}
+			i, found := slices.BinarySearchFunc(bounds, key, bytes.Compare)
+			if found {
+				i++
+			}
+			return i
+		},
+		Description: map[string]any{"type": "range", "bounds": bounds},
+	}, nil
+}
+
+// ShardManifest describes a ShardedDatabase once it has been closed.
+type ShardManifest struct {
+	// Partition is the Description of the Partitioner.
+	Partition any `json:"partition"`
+	// Shards describes each shard, in order.
+	Shards []ShardInfo `json:"shards"`
+}
+
+// ShardInfo describes one shard of a ShardedDatabase.
+type ShardInfo struct {
+	// PageCount is the size of the shard in pages.
+	PageCount uint32 `json:"page_count"`
+	// Rows is the number of rows written to each table of the shard.
+	Rows map[string]int64 `json:"rows"`
+}
+
+// OpenShardedDatabase prepares to write a ShardedDatabase with one shard per file,
+// using partitioner to choose the shard for each row.
+// The options apply to every shard.
+// It returns an error if there are no files.
+func OpenShardedDatabase(files []io.WriterAt, partitioner Partitioner, opts ...DatabaseOption) (*ShardedDatabase, error) {
+	return openShardedDatabase(files, partitioner, func(file io.WriterAt) *Database {
+		return OpenDatabase(file, opts...)
+	})
+}
+
+// OpenShardedDatabaseContext is like OpenShardedDatabase,
+// but if ctx is canceled before Close every shard fails with the context's cause.
+func OpenShardedDatabaseContext(ctx context.Context, files []io.WriterAt, partitioner Partitioner, opts ...DatabaseOption) (*ShardedDatabase, error) {
+	return openShardedDatabase(files, partitioner, func(file io.WriterAt) *Database {
+		return OpenDatabaseContext(ctx, file, opts...)
+	})
+}
+
+func openShardedDatabase(files []io.WriterAt, partitioner Partitioner, open func(io.WriterAt) *Database) (*ShardedDatabase, error) {
+	if len(files) == 0 {
+		return nil, errors.New("no shards")
+	}
+	sdb := &ShardedDatabase{partitioner: partitioner}
+	sdb.manifest.Partition = partitioner.Description
+	for _, file := range files {
+		sdb.shards = append(sdb.shards, open(file))
+		sdb.manifest.Shards = append(sdb.manifest.Shards, ShardInfo{Rows: make(map[string]int64)})
+	}
+	return sdb, nil
+}
+
+// Shards returns the Databases the ShardedDatabase writes to.
+func (sdb *ShardedDatabase) Shards() []*Database {
+	return slices.Clone(sdb.shards)
+}
+
+// fail makes every shard fail with the error its shard failed with,
+// and returns that error.
+func (sdb *ShardedDatabase) fail(shard int) error {
+	err := sdb.shards[shard].Err()
+	for _, db := range sdb.shards {
+		db.fail(err)
+	}
+	return err
+}
+
+// Close closes every shard, returning the first error.
+// Once any shard has failed, every shard that is still open fails with the same error,
+// so only the shards closed before the failure, if any, are complete.
+func (sdb *ShardedDatabase) Close() error {
+	for i, db := range sdb.shards {
+		if db.check() != nil {
+			sdb.fail(i)
+			break
+		}
+	}
+
+	var err error
+	for i, db := range sdb.shards {
+		if closeErr := db.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			}
+			if db.check() != nil {
+				for _, rest := range sdb.shards[i+1:] {
+					rest.fail(db.Err())
+				}
+			}
+			continue
+		}
+
+		sdb.manifestLock.Lock()
+		sdb.manifest.Shards[i].PageCount = db.Header().PageCount
+		sdb.manifestLock.Unlock()
+	}
+	return err
+}
+
+// Manifest returns the manifest describing the ShardedDatabase,
+// which is complete once it has been closed.
+func (sdb *ShardedDatabase) Manifest() ShardManifest {
+	sdb.manifestLock.Lock()
+	defer sdb.manifestLock.Unlock()
+
+	m := ShardManifest{Partition: sdb.manifest.Partition}
+	for _, shard := range sdb.manifest.Shards {
+		m.Shards = append(m.Shards, ShardInfo{PageCount: shard.PageCount, Rows: maps.Clone(shard.Rows)})
+	}
+	return m
+}
+
+// WriteManifest writes the manifest describing the ShardedDatabase to w as JSON.
+func (sdb *ShardedDatabase) WriteManifest(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(sdb.Manifest())
+}
+
+// OpenTable opens a table on every shard.
+func (sdb *ShardedDatabase) OpenTable(opts ...TableOption) *ShardedTable {
+	tbl := &ShardedTable{parent: sdb, rows: make([]int64, len(sdb.shards))}
+	for _, db := range sdb.shards {
+		tbl.tables = append(tbl.tables, db.OpenTable(opts...))
+	}
+	return tbl
+}
+
+// ShardedTable represents a table being created on every shard of a ShardedDatabase.
+type ShardedTable struct {
+	parent *ShardedDatabase
+	tables []*Table
+
+	// rowsLock protects rows.
+	rowsLock sync.Mutex
+	// rows is the number of rows written to each shard by closed streams.
+	rows []int64
+}
+
+// OpenStream opens a ShardedTableStream for writing to this table.
+// The streams of the shards are opened as rows are written to them,
+// and assign rowids automatically.
+func (tbl *ShardedTable) OpenStream() *ShardedTableStream {
+	return &ShardedTableStream{
+		parent:  tbl,
+		streams: make([]*TableStream, len(tbl.tables)),
+		rows:    make([]int64, len(tbl.tables)),
+	}
+}
+
+// Close closes the table on every shard, returning the first error.
+// All ShardedTableStreams must be closed before calling Close.
+func (tbl *ShardedTable) Close(name, sql string) error {
+	var err error
+	for i, t := range tbl.tables {
+		if closeErr := t.Close(name, sql); closeErr != nil && err == nil {
+			err = closeErr
+			if tbl.parent.shards[i].check() != nil {
+				err = tbl.parent.fail(i)
+			}
+		}
+
+		tbl.rowsLock.Lock()
+		rows := tbl.rows[i]
+		tbl.rowsLock.Unlock()
+		tbl.parent.manifestLock.Lock()
+		tbl.parent.manifest.Shards[i].Rows[name] = rows
+		tbl.parent.manifestLock.Unlock()
+	}
+	return err
+}
+
+// ShardedTableStream represents one stream of data being written to a ShardedTable.
+// ShardedTableStreams are not thread-safe; open one ShardedTableStream per worker goroutine.
+type ShardedTableStream struct {
+	parent  *ShardedTable
+	streams []*TableStream
+	rows    []int64
+}
+
+// WriteRow writes one row to the shard chosen for key,
+// returning the shard and the rowid the row was assigned in it.
+// Like TableStream.WriteRow, it does not retain row.
+func (s *ShardedTableStream) WriteRow(key, row []byte) (shard int, rowid int64, err error) {
+	shard = s.parent.parent.partitioner.Shard(key, len(s.streams))
+	if shard < 0 || shard >= len(s.streams) {
+		return shard, 0, fmt.Errorf("partitioner returned shard %d of %d", shard, len(s.streams))
+	}
+	if s.streams[shard] == nil {
+		s.streams[shard] = s.parent.tables[shard].OpenStream()
+	}
+
+	rowid, err = s.streams[shard].WriteRow(row)
+	if err != nil {
+		if s.parent.parent.shards[shard].check() != nil {
+			err = s.parent.parent.fail(shard)
+		}
+		return shard, 0, err
+	}
+	s.rows[shard]++
+	return shard, rowid, nil
+}
+
+// Close closes the stream of every shard that was written to, returning the first error.
+func (s *ShardedTableStream) Close() error {
+	var err error
+	for i, stream := range s.streams {
+		if stream == nil {
+			continue
+		}
+		if closeErr := stream.Close(); closeErr != nil && err == nil {
+			err = closeErr
+			if s.parent.parent.shards[i].check() != nil {
+				err = s.parent.parent.fail(i)
+			}
+		}
+		s.streams[i] = nil
+	}
+
+	s.parent.rowsLock.Lock()
+	defer s.parent.rowsLock.Unlock()
+	for i, rows := range s.rows {
+		s.parent.rows[i] += rows
+		s.rows[i] = 0
+	}
+	return err
+}
@@ -0,0 +1,216 @@
+package rawlite_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestPartitionerOutOfRange checks that a shard out of range is an error rather than a panic.
+func TestPartitionerOutOfRange(t *testing.T) {
+	p, err := rawlite.RangePartitioner([]byte("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdb, err := rawlite.OpenShardedDatabase([]io.WriterAt{&memFile{}, &memFile{}}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sdb.OpenTable().OpenStream()
+	if _, _, err := s.WriteRow([]byte("a"), []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	sdb, err = rawlite.OpenShardedDatabase([]io.WriterAt{&memFile{}, &memFile{}, &memFile{}}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = sdb.OpenTable().OpenStream()
+	if _, _, err := s.WriteRow([]byte("a"), []byte{1}); err == nil {
+		t.Error("RangePartitioner with the wrong number of shards: no error")
+	}
+}
+
+func TestShardedOpenErrors(t *testing.T) {
+	if _, err := rawlite.RangePartitioner([]byte("m"), []byte("m")); err == nil {
+		t.Error("RangePartitioner with repeated bounds: no error")
+	}
+	if _, err := rawlite.RangePartitioner([]byte("m"), []byte("a")); err == nil {
+		t.Error("RangePartitioner with decreasing bounds: no error")
+	}
+	if _, err := rawlite.OpenShardedDatabase(nil, rawlite.HashPartitioner()); err == nil {
+		t.Error("OpenShardedDatabase with no files: no error")
+	}
+}
+
+// TestShardedDatabase checks that every row is written to the shard its partitioner chooses,
+// and that the manifest counts the rows of each shard.
+func TestShardedDatabase(t *testing.T) {
+	ranges, err := rawlite.RangePartitioner([]byte("k03000"), []byte("k06000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, p := range map[string]rawlite.Partitioner{"hash": rawlite.HashPartitioner(), "range": ranges} {
+		t.Run(name, func(t *testing.T) {
+			const streams, rows = 4, 2500
+			files := []*memFile{{}, {}, {}}
+			sdb, err := rawlite.OpenShardedDatabase([]io.WriterAt{files[0], files[1], files[2]}, p, rawlite.PageSize(1024))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tables := map[string]*rawlite.ShardedTable{"t": sdb.OpenTable(), "u": sdb.OpenTable()}
+
+			var wg sync.WaitGroup
+			for name, tbl := range tables {
+				for i := range streams {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						s := tbl.OpenStream()
+						var rec record.Record
+						for j := i * rows; j < (i+1)*rows; j++ {
+							key := fmt.Sprintf("k%05d", j)
+							rec.Reset()
+							rec.AppendString(key)
+							rec.AppendString(strings.Repeat(name, j%500))
+							if _, _, err := s.WriteRow([]byte(key), rec.AppendTo(nil)); err != nil {
+								t.Error(err)
+								return
+							}
+						}
+						if err := s.Close(); err != nil {
+							t.Error(err)
+						}
+					}()
+				}
+			}
+			wg.Wait()
+			for name, tbl := range tables {
+				if err := tbl.Close(name, "CREATE TABLE "+name+"(k, v)"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sdb.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			m := sdb.Manifest()
+			for name := range tables {
+				total := int64(0)
+				for i, f := range files {
+					var keys []string
+					if out := querySQLite(t, f, "SELECT k FROM "+name); out != "" {
+						keys = strings.Split(out, "\n")
+					}
+					if got := m.Shards[i].Rows[name]; got != int64(len(keys)) {
+						t.Errorf("table %s, shard %d: manifest has %d rows, want %d", name, i, got, len(keys))
+					}
+					total += int64(len(keys))
+					for _, key := range keys {
+						if shard := p.Shard([]byte(key), len(files)); shard != i {
+							t.Fatalf("table %s: key %s in shard %d, want %d", name, key, i, shard)
+						}
+					}
+				}
+				if total != streams*rows {
+					t.Errorf("table %s: %d rows, want %d", name, total, streams*rows)
+				}
+			}
+			for i, f := range files {
+				checkDatabase(t, f)
+				if got, want := m.Shards[i].PageCount, uint32(len(f.data)/1024); got != want {
+					t.Errorf("shard %d: manifest page count %d, want %d", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// TestShardedDatabaseFailure checks that a shard that fails while rows are written
+// makes every shard fail, so none of them gets a database header.
+func TestShardedDatabaseFailure(t *testing.T) {
+	files := []*memFile{{}, {}}
+	sdb, err := rawlite.OpenShardedDatabase([]io.WriterAt{files[0], failingFile{}, files[1]}, rawlite.HashPartitioner(), rawlite.PageSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := sdb.OpenTable()
+	s := tbl.OpenStream()
+	for i := 0; err == nil && i < 10000; i++ {
+		_, _, err = s.WriteRow([]byte(fmt.Sprint(i)), overflowRow(i))
+	}
+	if !errors.Is(err, errWrite) {
+		t.Fatalf("WriteRow: got %v, want errWrite", err)
+	}
+	for i, db := range sdb.Shards() {
+		if err := db.Err(); !errors.Is(err, errWrite) {
+			t.Errorf("shard %d: got %v, want errWrite", i, err)
+		}
+	}
+	s.Close()
+	tbl.Close("t", "CREATE TABLE t(a, b)")
+	if err := sdb.Close(); !errors.Is(err, errWrite) {
+		t.Errorf("Close: got %v, want errWrite", err)
+	}
+	for i, f := range files {
+		if bytes.HasPrefix(f.data, []byte("SQLite format 3\x00")) {
+			t.Errorf("file %d has a header", i)
+		}
+	}
+}
+
+// headerFailingFile is a database file that fails when Close writes page 1.
+type headerFailingFile struct {
+	memFile
+}
+
+func (f *headerFailingFile) WriteAt(p []byte, off int64) (int, error) {
+	if off == 0 {
+		return 0, errWrite
+	}
+	return f.memFile.WriteAt(p, off)
+}
+
+// TestShardedDatabaseCloseFailure checks that a shard that fails when it is closed
+// makes the shards after it fail too.
+func TestShardedDatabaseCloseFailure(t *testing.T) {
+	files := []*memFile{{}, {}}
+	sdb, err := rawlite.OpenShardedDatabase([]io.WriterAt{files[0], &headerFailingFile{}, files[1]}, rawlite.HashPartitioner(), rawlite.PageSize(512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbl := sdb.OpenTable()
+	s := tbl.OpenStream()
+	for i := range 1000 {
+		if _, _, err := s.WriteRow([]byte(fmt.Sprint(i)), overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdb.Close(); !errors.Is(err, errWrite) {
+		t.Errorf("Close: got %v, want errWrite", err)
+	}
+
+	shards := sdb.Shards()
+	if err := shards[0].Err(); err != nil {
+		t.Errorf("shard 0, closed before the failure: %v", err)
+	}
+	checkDatabase(t, files[0])
+	if err := shards[2].Err(); !errors.Is(err, errWrite) {
+		t.Errorf("shard 2: got %v, want errWrite", err)
+	}
+	if bytes.HasPrefix(files[1].data, []byte("SQLite format 3\x00")) {
+		t.Error("shard 2 has a header")
+	}
+}
@@ -1,58 +1,193 @@
 package rawlite
 
 import (
+	"cmp"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"github.com/jordanwade90/rawlite/internal/pagebuf"
 	"github.com/jordanwade90/rawlite/internal/svarint"
+	"slices"
 	"sync"
+	"sync/atomic"
 )
 
-const (
-	pageSize       = 65536
-	minRowSize     = 4
-	maxRowsPerPage = pageSize / minRowSize
-)
+// minRowSize is the size of the smallest possible table leaf cell,
+// which limits how many rowids a leaf page can use.
+const minRowSize = 4
 
 // Table represents a table being created.
 type Table struct {
 	parent *Database
 
-	// interiorLock protects interiorNodes.
+	// interiorLock protects interiorNodes, autoRowids, ranges, and closed.
 	interiorLock  sync.Mutex
 	interiorNodes []*pagebuf.TableInterior
 	interiorPage  []byte
 	closed        bool
+
+	// autoRowids is set once a stream has been opened with OpenStream.
+	autoRowids bool
+	// ranges holds the rowid ranges of the streams opened with OpenStreamRange
+	// and, once they are closed, the leaf pages they wrote.
+	ranges []rowidRange
+
+	// denseRowids is set by the DenseRowids option.
+	denseRowids bool
+	// denseRows is the number of rows on the leaf pages of a table with denseRowids
+	// that have been added to the B-tree.
+	// It is only changed while holding interiorLock,
+	// but streams read it to estimate the rowids of the rows they are writing.
+	denseRows atomic.Int64
+
+	// schema is set by the ValidateRows option.
+	schema *Schema
+
+	// rowidBase is added to the rowids the Table assigns automatically,
+	// so that the parts of a RollingDatabase don't share rowids.
+	rowidBase int64
+}
+
+// A TableOption configures a Table.
+type TableOption func(*Table)
+
+// DenseRowids makes the rowids of the table run from 1 to the number of rows, in page order.
+//
+// Rows are numbered as each TableStream fills a leaf page and writes it,
+// continuing from the pages written before it by every stream,
+// so the rows of each stream are in the order they were written,
+// but the pages of different streams are interleaved.
+// WriteRow can't know a row's rowid yet, so it returns 0.
+// DenseRowids cannot be used with OpenStreamRange.
+func DenseRowids() TableOption {
+	return func(tbl *Table) {
+		tbl.denseRowids = true
+	}
+}
+
+// rowidRange is a range of rowids reserved by OpenStreamRange.
+type rowidRange struct {
+	first, last int64
+	leaves      []tableChild
 }
 
 // OpenStream opens a TableStream for writing to this table.
+//
+// The TableStream assigns rowids automatically.
+// A Table cannot have streams opened with both OpenStream and OpenStreamRange;
+// if the Table has a stream opened with OpenStreamRange,
+// the Database fails with an error wrapping ErrMixedRowids.
+// If the Table is closed, writing to the stream returns ErrClosed.
 func (tbl *Table) OpenStream() *TableStream {
+	tbl.interiorLock.Lock()
+	defer tbl.interiorLock.Unlock()
+
+	if len(tbl.ranges) != 0 {
+		tbl.parent.fail(fmt.Errorf("%w: OpenStream on a table with rowid ranges", ErrMixedRowids))
+	}
+	tbl.autoRowids = true
+
 	return &TableStream{
-		parent: tbl,
-		page:   pagebuf.NewTableLeaf(pageSize),
-		cell:   make([]byte, 0, pageSize),
+		parent:     tbl,
+		page:       pagebuf.NewTableLeaf(tbl.parent.pageSize),
+		cell:       make([]byte, 0, tbl.parent.pageSize),
+		rangeIndex: -1,
 	}
 }
 
+// OpenStreamRange opens a TableStream for writing rows
+// whose rowids are between first and last, inclusive.
+// Rows must be written in increasing rowid order,
+// and the range must not overlap the range of any other stream on the table,
+// but the rows of different streams may be written in any order.
+//
+// Use WriteRowWithID to choose each row's rowid,
+// for example to store an INTEGER PRIMARY KEY column;
+// WriteRow assigns the smallest rowid after the previous row's.
+// A Table cannot have streams opened with both OpenStream and OpenStreamRange.
+// OpenStreamRange returns an error wrapping ErrMixedRowids
+// if the Table has a stream opened with OpenStream or DenseRowids,
+// and one wrapping ErrRowidRange if first is greater than last
+// or if the range overlaps the range of another stream,
+// since choosing ranges that don't overlap is up to the caller.
+// If the Table is closed, closing the stream returns ErrClosed.
+func (tbl *Table) OpenStreamRange(first, last int64) (*TableStream, error) {
+	tbl.interiorLock.Lock()
+	defer tbl.interiorLock.Unlock()
+
+	if tbl.autoRowids {
+		return nil, fmt.Errorf("%w: OpenStreamRange on a table with automatic rowids", ErrMixedRowids)
+	}
+	if tbl.denseRowids {
+		return nil, fmt.Errorf("%w: OpenStreamRange on a table with dense rowids", ErrMixedRowids)
+	}
+	if first > last {
+		return nil, fmt.Errorf("%w: empty range %d to %d", ErrRowidRange, first, last)
+	}
+	for _, r := range tbl.ranges {
+		if first <= r.last && r.first <= last {
+			return nil, fmt.Errorf("%w: range %d to %d overlaps %d to %d", ErrRowidRange, first, last, r.first, r.last)
+		}
+	}
+	// NOTE(jw): a stream opened on a closed Table gets a rangeIndex past the end of ranges,
+	// which finishRange never uses because it checks for closed first.
+	rangeIndex := len(tbl.ranges)
+	if !tbl.closed {
+		tbl.ranges = append(tbl.ranges, rowidRange{first: first, last: last})
+	}
+
+	return &TableStream{
+		parent:     tbl,
+		page:       pagebuf.NewTableLeaf(tbl.parent.pageSize),
+		cell:       make([]byte, 0, tbl.parent.pageSize),
+		rangeIndex: rangeIndex,
+		nextRowid:  first,
+		lastRowid:  last,
+	}, nil
+}
+
 // Close closes the B-tree and informs the Database of the root page number.
+// All TableStreams must be closed before calling Close.
 func (tbl *Table) Close(name, sql string) error {
 	tbl.interiorLock.Lock()
 	defer tbl.interiorLock.Unlock()
 
 	if tbl.closed {
-		panic("table closed")
+		return ErrClosed
 	}
 	tbl.closed = true
 
+	if err := tbl.parent.check(); err != nil {
+		return err
+	}
+
+	if len(tbl.ranges) != 0 {
+		// Streams with rowid ranges don't allocate pages in rowid order,
+		// so their leaf pages are only added to the B-tree now.
+		slices.SortFunc(tbl.ranges, func(a, b rowidRange) int {
+			return cmp.Compare(a.first, b.first)
+		})
+		for _, r := range tbl.ranges {
+			for _, leaf := range r.leaves {
+				if err := tbl.addLeaf(leaf.pageNumber, leaf.rowid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
 	for i := 0; i < len(tbl.interiorNodes); i++ {
 		node := tbl.interiorNodes[i]
 		if node.Length() == 1 {
 			rootPage, _ := node.Remove()
-			tbl.parent.addTableSchemaRecord(name, sql, rootPage)
-			return nil
+			return tbl.parent.addTableSchemaRecord(name, sql, rootPage)
 		}
 
 		for {
-			pageNum := tbl.parent.allocPage()
+			pageNum, err := tbl.parent.allocPage()
+			if err != nil {
+				return err
+			}
 			rightmostRowid, empty := node.Put(tbl.interiorPage)
 			if err := tbl.parent.writePage(pageNum, tbl.interiorPage); err != nil {
 				return err
@@ -61,11 +196,10 @@ func (tbl *Table) Close(name, sql string) error {
 			if i+1 == len(tbl.interiorNodes) {
 				if empty {
 					// We just wrote the root page.
-					tbl.parent.addTableSchemaRecord(name, sql, pageNum)
-					return nil
+					return tbl.parent.addTableSchemaRecord(name, sql, pageNum)
 				}
 
-				tbl.interiorNodes = append(tbl.interiorNodes, pagebuf.NewTableInterior(pageSize))
+				tbl.interiorNodes = append(tbl.interiorNodes, pagebuf.NewTableInterior(tbl.parent.pageSize))
 			}
 			tbl.interiorNodes[i+1].Add(pageNum, rightmostRowid)
 
@@ -76,9 +210,14 @@ func (tbl *Table) Close(name, sql string) error {
 	}
 
 	// If there were no interior nodes the table must be empty.
-	rootPage := tbl.parent.allocPage()
-	tbl.parent.addTableSchemaRecord(name, sql, rootPage)
-	return tbl.parent.writePage(rootPage, pagebuf.NewTableLeaf(pageSize).Finish())
+	rootPage, err := tbl.parent.allocPage()
+	if err != nil {
+		return err
+	}
+	if err := tbl.parent.writePage(rootPage, pagebuf.NewTableLeaf(tbl.parent.pageSize).Finish()); err != nil {
+		return err
+	}
+	return tbl.parent.addTableSchemaRecord(name, sql, rootPage)
 }
 
 func (tbl *Table) allocRowidBlock() (int64, error) {
@@ -86,36 +225,63 @@ func (tbl *Table) allocRowidBlock() (int64, error) {
 	defer tbl.interiorLock.Unlock()
 
 	if tbl.closed {
-		panic("table closed")
+		return 0, ErrClosed
 	}
 
-	if len(tbl.interiorNodes) == 0 {
-		tbl.interiorNodes = append(tbl.interiorNodes, pagebuf.NewTableInterior(pageSize))
+	pageNum, err := tbl.parent.allocPage()
+	if err != nil {
+		return 0, err
 	}
+	firstRowid := tbl.rowidBase + int64(pageNum)*tbl.parent.maxRowsPerPage()
+	rightmostRowid := firstRowid + tbl.parent.maxRowsPerPage() - 1
+	return firstRowid, tbl.addLeaf(pageNum, rightmostRowid)
+}
 
-	pageNum := tbl.parent.allocPage()
-	firstRowid := int64(pageNum) * maxRowsPerPage
-	rightmostRowid := firstRowid + maxRowsPerPage - 1
-
+// addLeaf adds a leaf page to the B-tree,
+// writing any interior nodes that fill up as a result.
+// The caller must hold interiorLock.
+func (tbl *Table) addLeaf(pageNum pagebuf.PageNumber, rightmostRowid int64) error {
 	for i := 0; i < len(tbl.interiorNodes); i++ {
 		if tbl.interiorNodes[i].Add(pageNum, rightmostRowid) {
-			return firstRowid, nil
+			return nil
 		}
 
-		pageNum = tbl.parent.allocPage()
+		var err error
+		if pageNum, err = tbl.parent.allocPage(); err != nil {
+			return err
+		}
 		rightmostRowid, _ = tbl.interiorNodes[i].Put(tbl.interiorPage)
 		if err := tbl.parent.writePage(pageNum, tbl.interiorPage); err != nil {
-			return 0, err
+			return err
 		}
 	}
 
-	tbl.interiorNodes = append(tbl.interiorNodes, pagebuf.NewTableInterior(pageSize))
+	tbl.interiorNodes = append(tbl.interiorNodes, pagebuf.NewTableInterior(tbl.parent.pageSize))
 	tbl.interiorNodes[len(tbl.interiorNodes)-1].Add(pageNum, rightmostRowid)
-	return firstRowid, nil
+	return nil
+}
+
+func (tbl *Table) finishRange(rangeIndex int, leaves []tableChild, overflow []pagebuf.PageNumber) error {
+	tbl.interiorLock.Lock()
+	defer tbl.interiorLock.Unlock()
+
+	if tbl.closed {
+		// The leaves, and the overflow pages of their cells, will never be part of the B-tree.
+		for _, leaf := range leaves {
+			tbl.parent.freePage(leaf.pageNumber)
+		}
+		for _, pageNum := range overflow {
+			tbl.parent.freePage(pageNum)
+		}
+		return ErrClosed
+	}
+
+	tbl.ranges[rangeIndex].leaves = leaves
+	return nil
 }
 
 func (tbl *Table) writeLeaf(lastRowid int64, page []byte) error {
-	childPointer := pagebuf.PageNumber(lastRowid / maxRowsPerPage)
+	childPointer := pagebuf.PageNumber((lastRowid - tbl.rowidBase) / tbl.parent.maxRowsPerPage())
 	return tbl.parent.writePage(childPointer, page)
 }
 
@@ -128,13 +294,46 @@ type TableStream struct {
 	// cell is a reusable buffer for formatting cells
 	cell []byte
 	// The rowid of the next cell written.
+	// For streams with a rowid range, the smallest rowid that may be written next.
 	nextRowid int64
+
+	// rangeIndex is the position of the stream's range in parent.ranges,
+	// or -1 if the stream assigns rowids automatically.
+	rangeIndex int
+	// lastRowid is the largest rowid that may be written to a stream with a rowid range.
+	lastRowid int64
+	// pageRowid is the rowid of the last cell on page.
+	pageRowid int64
+	// leaves records the leaf pages written by a stream with a rowid range.
+	leaves []tableChild
+	// overflow records the overflow pages of the cells written by a stream with a rowid range,
+	// which must be freed along with its leaves if the Table is closed first.
+	// Streams that assign rowids automatically only use it for the row being written,
+	// unless the Table has denseRowids, where it holds those of the cells on page.
+	overflow []pagebuf.PageNumber
+	// spare is a second buffer for rebuilding the leaf pages of a table with denseRowids.
+	spare *pagebuf.TableLeaf
+	// closed is set once Close has handed the stream's leaves to the Table.
+	closed bool
 }
 
 // Close informs the parent Table that this TableStream is finished writing,
 // passing it any bookkeeping information required to construct the B-tree.
+// Closing a stream again does nothing.
 func (s *TableStream) Close() error {
-	return s.Flush()
+	if s.closed {
+		return nil
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.closed = true
+	if s.rangeIndex >= 0 {
+		err := s.parent.finishRange(s.rangeIndex, s.leaves, s.overflow)
+		s.leaves, s.overflow = nil, nil
+		return err
+	}
+	return nil
 }
 
 // Flush flushes any buffered pages.
@@ -144,6 +343,23 @@ func (s *TableStream) Flush() error {
 		return nil
 	}
 
+	if s.parent.denseRowids {
+		for !s.page.IsEmpty() {
+			if err := s.writeDenseLeaf(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if s.rangeIndex >= 0 {
+		pageNum, err := s.parent.parent.allocPage()
+		if err != nil {
+			return err
+		}
+		s.leaves = append(s.leaves, tableChild{pageNum, s.pageRowid})
+		return s.parent.parent.writePage(pageNum, s.page.Finish())
+	}
+
 	err := s.parent.writeLeaf(s.nextRowid-1, s.page.Finish())
 	s.nextRowid = 0
 	return err
@@ -152,24 +368,72 @@ func (s *TableStream) Flush() error {
 // WriteRow writes one row to the table whose contents are row,
 // returning the rowid assigned to the row
 // and any error resulting from writing pages to the database.
+// If the Table was opened with DenseRowids, WriteRow returns 0,
+// since rows are only numbered as their leaf pages are written.
+// If it was opened with ValidateRows, a row that doesn't match the schema is not written.
 //
 // WriteRow does not retain row.
 func (s *TableStream) WriteRow(row []byte) (rowid int64, err error) {
-	if s.nextRowid == 0 {
-		if s.nextRowid, err = s.parent.allocRowidBlock(); err != nil {
+	if err := s.parent.parent.check(); err != nil {
+		return 0, err
+	}
+	if s.rangeIndex >= 0 {
+		rowid = s.nextRowid
+		return rowid, s.WriteRowWithID(rowid, row)
+	}
+
+	if s.parent.schema != nil {
+		if err := s.parent.schema.Validate(row); err != nil {
 			return 0, err
 		}
 	}
 
+	// Write the overflow pages before reserving a rowid block,
+	// so that failing to write them can't leave the block's leaf page empty.
 	payloadLen := len(row)
-	overflowPointer, row, err := s.parent.parent.writeOverflowPages(row)
+	overflowPointer, row, err := s.parent.parent.writeOverflowPages(row, tableLeafPayloadOnPage(s.parent.parent.pageSize, payloadLen), &s.overflow)
 	if err != nil {
 		return 0, err
 	}
 
+	rowid, err = s.addCell(payloadLen, row, overflowPointer)
+	s.settleOverflow(err)
+	return rowid, err
+}
+
+// settleOverflow forgets the overflow pages of the row just written to a stream
+// that assigns rowids automatically, whose leaf page is already part of the B-tree,
+// or puts them on the freelist if addCell failed, so that the row's cell is on no page.
+// With denseRowids, the leaf page only becomes part of the B-tree once writeDenseLeaf writes it,
+// so the overflow pages are kept until then.
+func (s *TableStream) settleOverflow(err error) {
+	if err == nil && s.parent.denseRowids {
+		return
+	}
+	if err != nil {
+		for _, pageNum := range s.overflow {
+			s.parent.parent.freePage(pageNum)
+		}
+	}
+	s.overflow = s.overflow[:0]
+}
+
+// addCell adds a cell to a stream that assigns rowids automatically,
+// returning the rowid it assigned.
+// The overflow pages of the cell must already have been written.
+func (s *TableStream) addCell(payloadLen int, local []byte, overflowPointer pagebuf.PageNumber) (rowid int64, err error) {
+	if s.parent.denseRowids {
+		return 0, s.addDenseCell(payloadLen, local, overflowPointer)
+	}
+	if s.nextRowid == 0 {
+		if s.nextRowid, err = s.parent.allocRowidBlock(); err != nil {
+			return 0, err
+		}
+	}
+
 	for {
 		rowid = s.nextRowid
-		s.cell = appendTableRow(s.cell[:0], int64(payloadLen), rowid, row, overflowPointer)
+		s.cell = appendTableRow(s.cell[:0], int64(payloadLen), rowid, local, overflowPointer)
 		if s.page.Add(s.cell) {
 			s.nextRowid++
 			return
@@ -183,6 +447,158 @@ func (s *TableStream) WriteRow(row []byte) (rowid int64, err error) {
 	}
 }
 
+// addDenseCell adds a cell to a stream of a table with denseRowids.
+// The cell's rowid is only an estimate until writeDenseLeaf numbers the rows on the page.
+func (s *TableStream) addDenseCell(payloadLen int, local []byte, overflowPointer pagebuf.PageNumber) error {
+	for {
+		rowid := s.parent.denseRows.Load() + int64(s.page.NumCells()) + 1
+		s.cell = appendTableRow(s.cell[:0], int64(payloadLen), rowid, local, overflowPointer)
+		if s.page.Add(s.cell) {
+			return nil
+		}
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// writeDenseLeaf numbers the rows on the page of a stream of a table with denseRowids,
+// following the rows of the leaf pages already in the B-tree,
+// and writes the page as the next leaf page of the B-tree.
+// Rows that no longer fit once their rowids are known stay on the page.
+func (s *TableStream) writeDenseLeaf() error {
+	tbl := s.parent
+	pageSize := tbl.parent.pageSize
+	if s.spare == nil {
+		s.spare = pagebuf.NewTableLeaf(pageSize)
+	}
+	// The cells stay in old, the buffer of the emptied TableLeaf,
+	// while they are added again to the other one.
+	old := s.page.Finish()
+	s.page, s.spare = s.spare, s.page
+	numCells := int(binary.BigEndian.Uint16(old[3:]))
+
+	tbl.interiorLock.Lock()
+	if tbl.closed {
+		tbl.interiorLock.Unlock()
+		// The rows will never be part of the B-tree.
+		chain := 0
+		for i := range numCells {
+			payloadLen, _, _ := tableLeafCell(old, i, pageSize)
+			chain += overflowPageCount(pageSize, payloadLen)
+		}
+		for _, pageNum := range s.overflow[:chain] {
+			tbl.parent.freePage(pageNum)
+		}
+		s.overflow = append(s.overflow[:0], s.overflow[chain:]...)
+		return ErrClosed
+	}
+	rowid := tbl.denseRows.Load()
+	n, chain := 0, 0
+	for ; n < numCells; n++ {
+		payloadLen, local, overflowPointer := tableLeafCell(old, n, pageSize)
+		s.cell = appendTableRow(s.cell[:0], payloadLen, rowid+1, local, overflowPointer)
+		if !s.page.Add(s.cell) {
+			break
+		}
+		rowid++
+		chain += overflowPageCount(pageSize, payloadLen)
+	}
+	pageNum, err := tbl.parent.allocPage()
+	if err == nil {
+		tbl.denseRows.Store(rowid)
+		err = tbl.addLeaf(pageNum, rowid)
+	}
+	tbl.interiorLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := tbl.parent.writePage(pageNum, s.page.Finish()); err != nil {
+		return err
+	}
+	s.overflow = append(s.overflow[:0], s.overflow[chain:]...)
+
+	for i := n; i < numCells; i++ {
+		payloadLen, local, overflowPointer := tableLeafCell(old, i, pageSize)
+		s.cell = appendTableRow(s.cell[:0], payloadLen, rowid+int64(i-n)+1, local, overflowPointer)
+		s.page.Add(s.cell)
+	}
+	return nil
+}
+
+// WriteRowWithID writes one row to the table whose contents are row and whose rowid is rowid,
+// returning any error resulting from writing pages to the database.
+// The TableStream must have been opened with OpenStreamRange,
+// or WriteRowWithID returns ErrNoRowidRange,
+// and rowid must be within its range and greater than the rowid of the previous row,
+// or it returns an error wrapping ErrRowidRange.
+//
+// WriteRowWithID does not retain row.
+func (s *TableStream) WriteRowWithID(rowid int64, row []byte) error {
+	if s.rangeIndex < 0 {
+		return ErrNoRowidRange
+	}
+	if err := s.parent.parent.check(); err != nil {
+		return err
+	}
+	if rowid < s.nextRowid || rowid > s.lastRowid {
+		return fmt.Errorf("rowid %d: %w", rowid, ErrRowidRange)
+	}
+	if s.parent.schema != nil {
+		if err := s.parent.schema.Validate(row); err != nil {
+			return err
+		}
+	}
+
+	payloadLen := len(row)
+	overflowPointer, row, err := s.parent.parent.writeOverflowPages(row, tableLeafPayloadOnPage(s.parent.parent.pageSize, payloadLen), &s.overflow)
+	if err != nil {
+		return err
+	}
+
+	return s.addCellWithID(rowid, payloadLen, row, overflowPointer)
+}
+
+// addCellWithID adds a cell to a stream with a rowid range.
+// The caller must have checked that rowid is in the range,
+// and the overflow pages of the cell must already have been written.
+func (s *TableStream) addCellWithID(rowid int64, payloadLen int, local []byte, overflowPointer pagebuf.PageNumber) error {
+	s.cell = appendTableRow(s.cell[:0], int64(payloadLen), rowid, local, overflowPointer)
+	if !s.page.Add(s.cell) {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+		s.page.Add(s.cell)
+	}
+	s.pageRowid = rowid
+
+	if rowid == s.lastRowid {
+		// The range is used up; make sure nothing else can be written.
+		s.nextRowid, s.lastRowid = 1, 0
+	} else {
+		s.nextRowid = rowid + 1
+	}
+	return nil
+}
+
+// WriteRowContext is like WriteRow,
+// but if ctx is done it makes the Database fail with the context's cause instead.
+func (s *TableStream) WriteRowContext(ctx context.Context, row []byte) (rowid int64, err error) {
+	if ctx.Err() != nil {
+		return 0, s.parent.parent.fail(context.Cause(ctx))
+	}
+	return s.WriteRow(row)
+}
+
+// WriteRowWithIDContext is like WriteRowWithID,
+// but if ctx is done it makes the Database fail with the context's cause instead.
+func (s *TableStream) WriteRowWithIDContext(ctx context.Context, rowid int64, row []byte) error {
+	if ctx.Err() != nil {
+		return s.parent.parent.fail(context.Cause(ctx))
+	}
+	return s.WriteRowWithID(rowid, row)
+}
+
 func appendTableRow(buf []byte, payloadLen, rowid int64, row []byte, overflowPointer pagebuf.PageNumber) []byte {
 	buf = svarint.Append(buf, uint64(payloadLen))
 	buf = svarint.Append(buf, uint64(rowid))
@@ -193,6 +609,30 @@ func appendTableRow(buf []byte, payloadLen, rowid int64, row []byte, overflowPoi
 	return buf
 }
 
+func appendTableInteriorCell(buf []byte, leftChild pagebuf.PageNumber, rowid int64) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(leftChild))
+	return svarint.Append(buf, uint64(rowid))
+}
+
+// tableLeafCell returns the parts of cell i of a table leaf page of pageSize bytes.
+func tableLeafCell(page []byte, i, pageSize int) (payloadLen int64, local []byte, overflowPointer pagebuf.PageNumber) {
+	offset := int(binary.BigEndian.Uint16(page[pagebuf.TableLeafHeaderSize+2*i:]))
+	n, k := svarint.Get(page[offset:])
+	_, m := svarint.Get(page[offset+k:])
+	start := offset + k + m
+	onPage := tableLeafPayloadOnPage(pageSize, int(n))
+	if int(n) > onPage {
+		overflowPointer = pagebuf.PageNumber(binary.BigEndian.Uint32(page[start+onPage:]))
+	}
+	return int64(n), page[start : start+onPage], overflowPointer
+}
+
+// overflowPageCount returns the number of overflow pages of a table row with payloadLen bytes.
+func overflowPageCount(pageSize int, payloadLen int64) int {
+	overflow := int(payloadLen) - tableLeafPayloadOnPage(pageSize, int(payloadLen))
+	return (overflow + pageSize - 5) / (pageSize - 4)
+}
+
 func tableLeafPayloadOnPage(pageSize int, payloadSize int) int {
 	// See the "alternative description" of the payload overflow calculation
 	// from https://sqlite.org/fileformat2.html
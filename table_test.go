@@ -0,0 +1,121 @@
+package rawlite_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"strings"
+	"testing"
+)
+
+// TestDenseRowids checks that a table with DenseRowids has rowids from 1 to the number of rows,
+// in the order each stream wrote its rows.
+func TestDenseRowids(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rows int
+		text func(i int) string
+	}{
+		// Tiny rows cross the rowids where their varints get longer on nearly full pages.
+		{"tiny", 20000, func(i int) string { return "" }},
+		{"overflow", 2000, func(i int) string { return strings.Repeat("x", i*7%1500) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &memFile{}
+			db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+			tbl := db.OpenTable(rawlite.DenseRowids())
+			streams := []*rawlite.TableStream{tbl.OpenStream(), tbl.OpenStream(), tbl.OpenStream()}
+			for i := range tc.rows {
+				for k, s := range streams {
+					var rec record.Record
+					rec.AppendInt(int64(k))
+					rec.AppendInt(int64(i))
+					rec.AppendString(tc.text(i))
+					if _, err := s.WriteRow(rec.AppendTo(nil)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, s := range streams {
+				if err := s.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tbl.Close("t", "CREATE TABLE t(stream, seq, text)"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			checkDatabase(t, f)
+
+			want := fmt.Sprintf("%d|%d|1", 3*tc.rows, 3*tc.rows)
+			if got := querySQLite(t, f, "SELECT max(rowid), count(*), min(rowid) FROM t"); got != want {
+				t.Errorf("max(rowid), count(*), min(rowid): got %s, want %s", got, want)
+			}
+			// Each row of a stream must have a larger rowid than the row the stream wrote before it.
+			sql := "SELECT count(*) FROM (SELECT seq - lag(seq) OVER (PARTITION BY stream ORDER BY rowid) AS d FROM t) WHERE d != 1"
+			if got := querySQLite(t, f, sql); got != "0" {
+				t.Errorf("%s rows are out of stream order", got)
+			}
+		})
+	}
+}
+
+func TestOpenStreamRangeErrors(t *testing.T) {
+	db := rawlite.OpenDatabase(&memFile{})
+	tbl := db.OpenTable()
+	if _, err := tbl.OpenStreamRange(1, 100); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range [][2]int64{{2, 1}, {100, 200}, {-10, 1}} {
+		if _, err := tbl.OpenStreamRange(r[0], r[1]); !errors.Is(err, rawlite.ErrRowidRange) {
+			t.Errorf("range %d to %d: got %v, want ErrRowidRange", r[0], r[1], err)
+		}
+	}
+	if err := db.Err(); err != nil {
+		t.Fatalf("invalid ranges made the Database fail: %v", err)
+	}
+
+	tbl.OpenStream()
+	if err := db.Err(); !errors.Is(err, rawlite.ErrMixedRowids) {
+		t.Errorf("OpenStream on a table with ranges: got %v, want ErrMixedRowids", err)
+	}
+
+	tbl = rawlite.OpenDatabase(&memFile{}).OpenTable(rawlite.DenseRowids())
+	if _, err := tbl.OpenStreamRange(1, 100); !errors.Is(err, rawlite.ErrMixedRowids) {
+		t.Errorf("OpenStreamRange with DenseRowids: got %v, want ErrMixedRowids", err)
+	}
+}
+
+// TestCloseStreamTwice checks that closing a TableStream a second time keeps its rows.
+func TestCloseStreamTwice(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenTable()
+	s, err := tbl.OpenStreamRange(1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 1000; i++ {
+		if err := s.WriteRowWithID(int64(i), overflowRow(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range 2 {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.Close("t", "CREATE TABLE t(a, b)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+	if got := querySQLite(t, f, "SELECT count(*) FROM t"); got != "1000" {
+		t.Errorf("got %s rows, want 1000", got)
+	}
+}
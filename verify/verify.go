@@ -0,0 +1,609 @@
+// Package verify checks the structure of SQLite database files
+// without depending on SQLite itself.
+//
+// It covers the subset of `PRAGMA integrity_check` that applies to files written by rawlite:
+// the database header, the freelist, every B-tree page reachable from `sqlite_schema`
+// (cell pointers, cell sizes, rowid order, interior key bounds, and overflow chains),
+// and that every page in the file is used exactly once.
+// Unlike SQLite, it requires the in-header database size to be valid,
+// since rawlite always writes it.
+// It does not check that indexes agree with their tables
+// or that index keys are in order, since that depends on the collations
+// declared in the schema.
+package verify
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jordanwade90/rawlite/internal/svarint"
+	"github.com/jordanwade90/rawlite/record"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Error describes one problem found in a database file.
+type Error struct {
+	// Tree is the root page of the B-tree being checked when the problem was found,
+	// or zero if the problem is not in a B-tree.
+	Tree uint32
+	// Page is the page with the problem, or zero if it concerns the whole file.
+	Page uint32
+	// Msg describes the problem.
+	Msg string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Tree != 0:
+		return fmt.Sprintf("tree %d page %d: %s", e.Tree, e.Page, e.Msg)
+	case e.Page != 0:
+		return fmt.Sprintf("page %d: %s", e.Page, e.Msg)
+	default:
+		return e.Msg
+	}
+}
+
+// Errors lists every problem found in a database file.
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// maxErrors limits how many problems Check reports,
+// since a badly damaged file can have a problem on every page.
+const maxErrors = 100
+
+var errTooManyErrors = errors.New("too many errors")
+
+// Check checks the database file read from r.
+// It returns the error from r if the file can't be read,
+// or an Errors listing the problems found if the file is damaged.
+func Check(r io.ReaderAt) error {
+	c := &checker{r: r}
+	err := c.check()
+	if err != nil && err != errTooManyErrors {
+		return err
+	}
+	if len(c.errs) != 0 {
+		return c.errs
+	}
+	return nil
+}
+
+type checker struct {
+	r         io.ReaderAt
+	pageSize  int
+	usable    int
+	pageCount uint32
+	lockByte  uint32
+	refs      []bool
+	errs      Errors
+
+	// schemaRows collects the payloads of the rows of sqlite_schema.
+	schemaRows [][]byte
+}
+
+func (c *checker) errorf(tree, page uint32, format string, args ...any) error {
+	c.errs = append(c.errs, &Error{Tree: tree, Page: page, Msg: fmt.Sprintf(format, args...)})
+	if len(c.errs) >= maxErrors {
+		return errTooManyErrors
+	}
+	return nil
+}
+
+func (c *checker) readPage(pageNumber uint32) ([]byte, error) {
+	page := make([]byte, c.pageSize)
+	err := readFull(c.r, page, int64(pageNumber-1)*int64(c.pageSize))
+	return page, err
+}
+
+// readFull reads len(p) bytes from r at off.
+// A ReaderAt may return io.EOF along with the last bytes of its input,
+// so a complete read succeeds whatever the error.
+func readFull(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	return err
+}
+
+// ref marks a page as used, returning false if it can't be used.
+func (c *checker) ref(tree, from, pageNumber uint32) (bool, error) {
+	switch {
+	case pageNumber == 0 || pageNumber > c.pageCount:
+		return false, c.errorf(tree, from, "invalid page number %d", pageNumber)
+	case pageNumber == c.lockByte:
+		return false, c.errorf(tree, from, "reference to the lock-byte page %d", pageNumber)
+	case c.refs[pageNumber]:
+		return false, c.errorf(tree, from, "2nd reference to page %d", pageNumber)
+	}
+	c.refs[pageNumber] = true
+	return true, nil
+}
+
+func (c *checker) check() error {
+	hdr := make([]byte, 100)
+	if err := readFull(c.r, hdr, 0); err != nil {
+		if err == io.EOF {
+			return c.errorf(0, 0, "file is too short to be a database")
+		}
+		return err
+	}
+	if err := c.checkHeader(hdr); err != nil || c.pageCount == 0 {
+		return err
+	}
+
+	// Make sure the file contains every page the header says it does.
+	if _, err := c.readPage(c.pageCount); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return c.errorf(0, 0, "file is shorter than the %d pages in the header", c.pageCount)
+		}
+		return err
+	}
+
+	c.refs = make([]bool, c.pageCount+1)
+	if c.lockByte <= c.pageCount {
+		c.refs[c.lockByte] = true
+	}
+
+	if err := c.checkFreelist(binary.BigEndian.Uint32(hdr[32:]), binary.BigEndian.Uint32(hdr[36:])); err != nil {
+		return err
+	}
+	if err := c.checkTree(1, false); err != nil {
+		return err
+	}
+	if err := c.checkSchema(); err != nil {
+		return err
+	}
+
+	for pageNumber := uint32(1); pageNumber <= c.pageCount; pageNumber++ {
+		if !c.refs[pageNumber] {
+			if err := c.errorf(0, pageNumber, "never used"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkHeader(hdr []byte) error {
+	if string(hdr[:16]) != "SQLite format 3\000" {
+		return c.errorf(0, 0, "not a SQLite database")
+	}
+
+	c.pageSize = int(binary.BigEndian.Uint16(hdr[16:]))
+	if c.pageSize == 1 {
+		c.pageSize = 65536
+	}
+	if c.pageSize < 512 || c.pageSize > 65536 || c.pageSize&(c.pageSize-1) != 0 {
+		return c.errorf(0, 0, "invalid page size %d", c.pageSize)
+	}
+	c.usable = c.pageSize - int(hdr[20])
+	if c.usable < 480 {
+		return c.errorf(0, 0, "usable page size %d is too small", c.usable)
+	}
+	c.lockByte = uint32(1073741824/c.pageSize + 1)
+
+	if hdr[18] != 1 && hdr[18] != 2 || hdr[19] != 1 && hdr[19] != 2 {
+		if err := c.errorf(0, 0, "invalid file format version %d.%d", hdr[18], hdr[19]); err != nil {
+			return err
+		}
+	}
+	if hdr[21] != 64 || hdr[22] != 32 || hdr[23] != 32 {
+		if err := c.errorf(0, 0, "invalid payload fractions %d/%d/%d", hdr[21], hdr[22], hdr[23]); err != nil {
+			return err
+		}
+	}
+	if schemaFormat := binary.BigEndian.Uint32(hdr[44:]); schemaFormat < 1 || schemaFormat > 4 {
+		if err := c.errorf(0, 0, "invalid schema format %d", schemaFormat); err != nil {
+			return err
+		}
+	}
+	if encoding := binary.BigEndian.Uint32(hdr[56:]); encoding < 1 || encoding > 3 {
+		if err := c.errorf(0, 0, "invalid text encoding %d", encoding); err != nil {
+			return err
+		}
+	}
+
+	if binary.BigEndian.Uint32(hdr[24:]) != binary.BigEndian.Uint32(hdr[92:]) {
+		return c.errorf(0, 0, "in-header database size is not valid: change counter %d but version-valid-for %d",
+			binary.BigEndian.Uint32(hdr[24:]), binary.BigEndian.Uint32(hdr[92:]))
+	}
+	c.pageCount = binary.BigEndian.Uint32(hdr[28:])
+	if c.pageCount == 0 {
+		return c.errorf(0, 0, "in-header database size is zero")
+	}
+	return nil
+}
+
+func (c *checker) checkFreelist(trunk, count uint32) error {
+	maxLeaves := uint32(c.usable/4 - 2)
+	found := uint32(0)
+	from := uint32(0)
+	for trunk != 0 {
+		ok, err := c.ref(0, from, trunk)
+		if err != nil || !ok {
+			return err
+		}
+		page, err := c.readPage(trunk)
+		if err != nil {
+			return err
+		}
+
+		numLeaves := binary.BigEndian.Uint32(page[4:])
+		if numLeaves > maxLeaves {
+			return c.errorf(0, trunk, "freelist leaf count %d is too big", numLeaves)
+		}
+		for i := uint32(0); i < numLeaves; i++ {
+			if _, err := c.ref(0, trunk, binary.BigEndian.Uint32(page[8+4*i:])); err != nil {
+				return err
+			}
+		}
+
+		found += 1 + numLeaves
+		from, trunk = trunk, binary.BigEndian.Uint32(page)
+	}
+
+	if found != count {
+		return c.errorf(0, 0, "freelist size is %d but should be %d", found, count)
+	}
+	return nil
+}
+
+// checkTree checks the B-tree rooted at root.
+func (c *checker) checkTree(root uint32, isIndex bool) error {
+	ok, err := c.ref(root, 0, root)
+	if err != nil || !ok {
+		return err
+	}
+	_, err = c.checkPage(root, root, isIndex, bounds{})
+	return err
+}
+
+// bounds restricts the rowids that may appear in a table B-tree page
+// to those greater than lo and at most hi.
+type bounds struct {
+	lo, hi       int64
+	hasLo, hasHi bool
+}
+
+func (b bounds) contains(rowid int64) bool {
+	return (!b.hasLo || rowid > b.lo) && (!b.hasHi || rowid <= b.hi)
+}
+
+// extent is the range of bytes occupied by a cell or freeblock.
+type extent struct {
+	start, end int
+}
+
+// checkPage checks a B-tree page and its children,
+// returning the depth of the leaves below it.
+func (c *checker) checkPage(tree, pageNumber uint32, isIndex bool, b bounds) (depth int, err error) {
+	page, err := c.readPage(pageNumber)
+	if err != nil {
+		return -1, err
+	}
+
+	hdr := 0
+	if pageNumber == 1 {
+		hdr = 100
+	}
+	var isLeaf bool
+	switch typ := page[hdr]; {
+	case typ == 13 && !isIndex || typ == 10 && isIndex:
+		isLeaf = true
+	case typ == 5 && !isIndex || typ == 2 && isIndex:
+		isLeaf = false
+	default:
+		return -1, c.errorf(tree, pageNumber, "invalid page type %d", typ)
+	}
+
+	headerSize := 8
+	if !isLeaf {
+		headerSize = 12
+	}
+	numCells := int(binary.BigEndian.Uint16(page[hdr+3:]))
+	contentStart := int(binary.BigEndian.Uint16(page[hdr+5:]))
+	if contentStart == 0 {
+		contentStart = 65536
+	}
+	pointersEnd := hdr + headerSize + 2*numCells
+	if pointersEnd > contentStart || contentStart > c.usable {
+		return -1, c.errorf(tree, pageNumber, "cell pointer array overlaps cell content area")
+	}
+	if numCells == 0 && pageNumber != tree {
+		return -1, c.errorf(tree, pageNumber, "page has no cells")
+	}
+
+	extents, err := c.freeblocks(tree, pageNumber, page, contentStart)
+	if err != nil || extents == nil {
+		return -1, err
+	}
+
+	depth = -1
+	checkChild := func(child uint32, b bounds) error {
+		ok, err := c.ref(tree, pageNumber, child)
+		if err != nil || !ok {
+			return err
+		}
+		childDepth, err := c.checkPage(tree, child, isIndex, b)
+		if err != nil {
+			return err
+		}
+		if childDepth < 0 {
+			// The child was damaged and its depth is unknown.
+			return nil
+		}
+		if depth >= 0 && childDepth != depth {
+			return c.errorf(tree, child, "child page depth differs")
+		}
+		depth = childDepth
+		return nil
+	}
+
+	prev := b.lo
+	hasPrev := b.hasLo
+	for i := 0; i < numCells; i++ {
+		start := int(binary.BigEndian.Uint16(page[hdr+headerSize+2*i:]))
+		if start < contentStart || start >= c.usable {
+			if err := c.errorf(tree, pageNumber, "cell %d offset %d is out of range", i, start); err != nil {
+				return -1, err
+			}
+			continue
+		}
+		cell := page[start:c.usable]
+
+		pos := 0
+		var child uint32
+		if !isLeaf {
+			if len(cell) < 4 {
+				return -1, c.errorf(tree, pageNumber, "cell %d extends off the end of the page", i)
+			}
+			child = binary.BigEndian.Uint32(cell)
+			pos = 4
+		}
+
+		// Table interior cells hold only a rowid; every other kind of cell holds a payload.
+		var payloadSize, rowid uint64
+		hasPayload := isLeaf || isIndex
+		if hasPayload {
+			var n int
+			if payloadSize, n = svarint.Get(cell[pos:]); n == 0 {
+				return -1, c.errorf(tree, pageNumber, "cell %d extends off the end of the page", i)
+			}
+			pos += n
+		}
+		if !isIndex {
+			var n int
+			if rowid, n = svarint.Get(cell[pos:]); n == 0 {
+				return -1, c.errorf(tree, pageNumber, "cell %d extends off the end of the page", i)
+			}
+			pos += n
+		}
+
+		var local int
+		if hasPayload {
+			if payloadSize > math.MaxInt32 {
+				return -1, c.errorf(tree, pageNumber, "cell %d payload size %d is too large", i, payloadSize)
+			}
+			local = c.payloadOnPage(int(payloadSize), isIndex)
+			if pos+local > len(cell) {
+				return -1, c.errorf(tree, pageNumber, "cell %d extends off the end of the page", i)
+			}
+			var payload []byte
+			if tree == 1 {
+				payload = append(payload, cell[pos:pos+local]...)
+			}
+			pos += local
+
+			if local < int(payloadSize) {
+				if pos+4 > len(cell) {
+					return -1, c.errorf(tree, pageNumber, "cell %d extends off the end of the page", i)
+				}
+				overflow := binary.BigEndian.Uint32(cell[pos:])
+				pos += 4
+				if payload, err = c.checkOverflow(tree, pageNumber, overflow, int(payloadSize)-local, payload); err != nil {
+					return -1, err
+				}
+			}
+			if tree == 1 && isLeaf {
+				c.schemaRows = append(c.schemaRows, payload)
+			}
+		}
+		extents = append(extents, extent{start, start + pos})
+
+		if !isIndex {
+			key := int64(rowid)
+			if hasPrev && key <= prev {
+				if err := c.errorf(tree, pageNumber, "rowid %d out of order", key); err != nil {
+					return -1, err
+				}
+			} else if !b.contains(key) {
+				if err := c.errorf(tree, pageNumber, "rowid %d out of range", key); err != nil {
+					return -1, err
+				}
+			}
+			if !isLeaf {
+				if err := checkChild(child, bounds{lo: prev, hasLo: hasPrev, hi: key, hasHi: true}); err != nil {
+					return -1, err
+				}
+			}
+			prev, hasPrev = key, true
+		} else if !isLeaf {
+			if err := checkChild(child, bounds{}); err != nil {
+				return -1, err
+			}
+		}
+	}
+
+	if !isLeaf {
+		rightmost := binary.BigEndian.Uint32(page[hdr+8:])
+		if err := checkChild(rightmost, bounds{lo: prev, hasLo: hasPrev, hi: b.hi, hasHi: b.hasHi}); err != nil {
+			return -1, err
+		}
+	}
+
+	if err := c.checkExtents(tree, pageNumber, extents, contentStart, int(page[hdr+7])); err != nil {
+		return -1, err
+	}
+	if !isLeaf && depth < 0 {
+		return -1, nil
+	}
+	return depth + 1, nil
+}
+
+// freeblocks returns the extents of the freeblocks on a page,
+// or nil if the freeblock list is damaged.
+func (c *checker) freeblocks(tree, pageNumber uint32, page []byte, contentStart int) ([]extent, error) {
+	hdr := 0
+	if pageNumber == 1 {
+		hdr = 100
+	}
+
+	extents := []extent{}
+	for offset := int(binary.BigEndian.Uint16(page[hdr+1:])); offset != 0; {
+		if offset < contentStart || offset+4 > c.usable {
+			return nil, c.errorf(tree, pageNumber, "freeblock offset %d is out of range", offset)
+		}
+		size := int(binary.BigEndian.Uint16(page[offset+2:]))
+		next := int(binary.BigEndian.Uint16(page[offset:]))
+		if size < 4 || offset+size > c.usable || next != 0 && next <= offset+size {
+			return nil, c.errorf(tree, pageNumber, "freeblock at offset %d is damaged", offset)
+		}
+		extents = append(extents, extent{offset, offset + size})
+		offset = next
+	}
+	return extents, nil
+}
+
+// checkExtents checks that no two cells or freeblocks on a page overlap,
+// and that the bytes of the cell content area they don't cover
+// are counted as fragmented.
+func (c *checker) checkExtents(tree, pageNumber uint32, extents []extent, contentStart, fragmented int) error {
+	slices.SortFunc(extents, func(a, b extent) int { return a.start - b.start })
+	used := 0
+	for i, e := range extents {
+		if i > 0 && e.start < extents[i-1].end {
+			return c.errorf(tree, pageNumber, "multiple uses for byte %d", e.start)
+		}
+		used += e.end - e.start
+	}
+	if unused := c.usable - contentStart - used; unused != fragmented {
+		return c.errorf(tree, pageNumber, "fragmentation of %d bytes reported as %d", unused, fragmented)
+	}
+	return nil
+}
+
+// checkOverflow follows an overflow chain holding size bytes of payload,
+// appending the payload to buf if it is not nil.
+func (c *checker) checkOverflow(tree, from, first uint32, size int, buf []byte) ([]byte, error) {
+	expected := (size + c.usable - 5) / (c.usable - 4)
+	pageNumber := first
+	for i := 0; i < expected; i++ {
+		if pageNumber == 0 {
+			return buf, c.errorf(tree, from, "overflow list length is %d but should be %d", i, expected)
+		}
+		ok, err := c.ref(tree, from, pageNumber)
+		if err != nil || !ok {
+			return buf, err
+		}
+		page, err := c.readPage(pageNumber)
+		if err != nil {
+			return buf, err
+		}
+		if buf != nil {
+			buf = append(buf, page[4:4+min(size, c.usable-4)]...)
+		}
+		size -= c.usable - 4
+		from, pageNumber = pageNumber, binary.BigEndian.Uint32(page)
+	}
+	if pageNumber != 0 {
+		return buf, c.errorf(tree, from, "overflow list is longer than %d pages", expected)
+	}
+	return buf, nil
+}
+
+// payloadOnPage returns how much of a payload is stored in its cell,
+// as described in https://sqlite.org/fileformat2.html
+func (c *checker) payloadOnPage(payloadSize int, isIndex bool) int {
+	U := c.usable
+	X := U - 35
+	if isIndex {
+		X = ((U - 12) * 64 / 255) - 23
+	}
+	M := ((U - 12) * 32 / 255) - 23
+	K := M + ((payloadSize - M) % (U - 4))
+	switch {
+	case payloadSize <= X:
+		return payloadSize
+	case K <= X:
+		return K
+	default:
+		return M
+	}
+}
+
+// withoutRowid matches the end of a CREATE TABLE statement for a WITHOUT ROWID table.
+var withoutRowid = regexp.MustCompile(`(?i)\)[^)]*\bWITHOUT\s+ROWID\b[^)]*$`)
+
+func (c *checker) checkSchema() error {
+	tables := map[string]bool{}
+	for i, row := range c.schemaRows {
+		values, err := record.Decode(row)
+		if err != nil || len(values) != 5 {
+			if err := c.errorf(1, 0, "sqlite_schema row %d is not a valid schema record", i+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		typ := string(values[0].Bytes)
+		name := string(values[1].Bytes)
+		tableName := string(values[2].Bytes)
+		rootPage := values[3].Int
+		sql := string(values[4].Bytes)
+
+		switch typ {
+		case "table":
+			tables[strings.ToLower(name)] = true
+			if rootPage == 0 && strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL TABLE") {
+				continue
+			}
+			if err := c.checkSchemaTree(name, rootPage, withoutRowid.MatchString(sql)); err != nil {
+				return err
+			}
+		case "index":
+			if !tables[strings.ToLower(tableName)] {
+				if err := c.errorf(1, 0, "index %q refers to table %q, which does not precede it in sqlite_schema", name, tableName); err != nil {
+					return err
+				}
+			}
+			if err := c.checkSchemaTree(name, rootPage, true); err != nil {
+				return err
+			}
+		case "view", "trigger":
+		default:
+			if err := c.errorf(1, 0, "sqlite_schema row %d has invalid type %q", i+1, typ); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) checkSchemaTree(name string, rootPage int64, isIndex bool) error {
+	if rootPage <= 0 || rootPage > int64(c.pageCount) {
+		return c.errorf(1, 0, "%q has invalid root page %d", name, rootPage)
+	}
+	return c.checkTree(uint32(rootPage), isIndex)
+}
@@ -0,0 +1,321 @@
+package verify_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"github.com/jordanwade90/rawlite/verify"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memFile is an in-memory database file.
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if end := int(off) + len(p); end > len(f.data) {
+		f.data = append(f.data, make([]byte, end-len(f.data))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return bytes.NewReader(f.data).ReadAt(p, off)
+}
+
+const pageSize = 512
+
+// write writes a database with page size 512, filling it with fill.
+func write(t *testing.T, fill func(db *rawlite.Database) error) []byte {
+	t.Helper()
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(pageSize))
+	if err := fill(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return f.data
+}
+
+// writeTable writes n rows made by row to a new table named t.
+func writeTable(db *rawlite.Database, n int, row func(rec *record.Record, i int)) error {
+	tbl := db.OpenTable()
+	s := tbl.OpenStream()
+	for i := range n {
+		var rec record.Record
+		row(&rec, i)
+		if _, err := s.WriteRow(rec.AppendTo(nil)); err != nil {
+			return err
+		}
+	}
+	if err := s.Close(); err != nil {
+		return err
+	}
+	return tbl.Close("t", "CREATE TABLE t(a, b)")
+}
+
+func emptyDatabase(t *testing.T) []byte {
+	return write(t, func(db *rawlite.Database) error { return nil })
+}
+
+// multiLevelDatabase has a table and an index whose B-trees have several levels of interior pages.
+func multiLevelDatabase(t *testing.T) []byte {
+	return write(t, func(db *rawlite.Database) error {
+		if err := writeTable(db, 20000, func(rec *record.Record, i int) {
+			rec.AppendInt(int64(i))
+			rec.AppendString(strings.Repeat("x", i%40))
+		}); err != nil {
+			return err
+		}
+		idx := db.OpenIndex()
+		s := idx.OpenStream()
+		for i := range 20000 {
+			var rec record.Record
+			rec.AppendInt(int64(i))
+			rec.AppendInt(int64(i + 1))
+			if err := s.WriteRecord(rec.AppendTo(nil)); err != nil {
+				return err
+			}
+		}
+		if err := s.Close(); err != nil {
+			return err
+		}
+		return idx.Close("i", "t", "CREATE INDEX i ON t(a)")
+	})
+}
+
+// overflowDatabase has rows that need one or several overflow pages.
+func overflowDatabase(t *testing.T) []byte {
+	return write(t, func(db *rawlite.Database) error {
+		return writeTable(db, 200, func(rec *record.Record, i int) {
+			rec.AppendInt(int64(i))
+			rec.AppendString(strings.Repeat("x", i*37))
+		})
+	})
+}
+
+// freelistDatabase has pages on the freelist,
+// the leaves of a range stream closed after its table.
+func freelistDatabase(t *testing.T) []byte {
+	return write(t, func(db *rawlite.Database) error {
+		tbl := db.OpenTable()
+		s, err := tbl.OpenStreamRange(1, 100000)
+		if err != nil {
+			return err
+		}
+		for i := int64(1); i <= 5000; i++ {
+			var rec record.Record
+			rec.AppendInt(i)
+			if err := s.WriteRowWithID(i, rec.AppendTo(nil)); err != nil {
+				return err
+			}
+		}
+		if err := tbl.Close("t", "CREATE TABLE t(a)"); err != nil {
+			return err
+		}
+		if err := s.Close(); err != rawlite.ErrClosed {
+			return fmt.Errorf("closing the stream after the table: got %v, want ErrClosed", err)
+		}
+		return nil
+	})
+}
+
+func TestCheckValid(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		write func(t *testing.T) []byte
+	}{
+		{"empty", emptyDatabase},
+		{"multi-level", multiLevelDatabase},
+		{"overflow", overflowDatabase},
+		{"freelist", freelistDatabase},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := verify.Check(bytes.NewReader(tc.write(t))); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// eofReader is a ReaderAt that returns io.EOF with a read that reaches the end of data,
+// as the io.ReaderAt contract allows.
+type eofReader struct {
+	data []byte
+}
+
+func (r eofReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := bytes.NewReader(r.data).ReadAt(p, off)
+	if err == nil && off+int64(n) == int64(len(r.data)) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// TestCheckEOF checks that a read of the last page that returns io.EOF with the whole page succeeds.
+func TestCheckEOF(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		write func(t *testing.T) []byte
+	}{
+		{"empty", emptyDatabase},
+		{"overflow", overflowDatabase},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.write(t)
+			if err := verify.Check(eofReader{data}); err != nil {
+				t.Error(err)
+			}
+			if err := verify.Check(eofReader{data[:len(data)-1]}); err == nil {
+				t.Error("Check of a truncated file: no error")
+			}
+		})
+	}
+}
+
+// findPage returns the number of the first page after page 1 whose B-tree page type is typ
+// and which has at least two cells.
+func findPage(t *testing.T, data []byte, typ byte) int {
+	t.Helper()
+	for n := 2; n*pageSize <= len(data); n++ {
+		page := data[(n-1)*pageSize : n*pageSize]
+		if page[0] == typ && binary.BigEndian.Uint16(page[3:]) >= 2 {
+			return n
+		}
+	}
+	t.Fatalf("no page of type %d", typ)
+	return 0
+}
+
+// page returns page n of data.
+func page(data []byte, n int) []byte {
+	return data[(n-1)*pageSize : n*pageSize]
+}
+
+func TestCheckCorrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		write   func(t *testing.T) []byte
+		corrupt func(t *testing.T, data []byte) []byte
+		want    string
+	}{
+		{"magic", emptyDatabase, func(t *testing.T, data []byte) []byte {
+			data[0] = 'X'
+			return data
+		}, "not a SQLite database"},
+		{"page size", emptyDatabase, func(t *testing.T, data []byte) []byte {
+			binary.BigEndian.PutUint16(data[16:], 768)
+			return data
+		}, "invalid page size 768"},
+		{"truncated", multiLevelDatabase, func(t *testing.T, data []byte) []byte {
+			return data[:len(data)-pageSize]
+		}, "file is shorter than"},
+		{"unused page", multiLevelDatabase, func(t *testing.T, data []byte) []byte {
+			binary.BigEndian.PutUint32(data[28:], binary.BigEndian.Uint32(data[28:])+1)
+			return append(data, make([]byte, pageSize)...)
+		}, "never used"},
+		{"page type", multiLevelDatabase, func(t *testing.T, data []byte) []byte {
+			page(data, findPage(t, data, 13))[0] = 7
+			return data
+		}, "invalid page type 7"},
+		{"rowid order", multiLevelDatabase, func(t *testing.T, data []byte) []byte {
+			p := page(data, findPage(t, data, 13))
+			// Swap the first two cell pointers.
+			a, b := binary.BigEndian.Uint16(p[8:]), binary.BigEndian.Uint16(p[10:])
+			binary.BigEndian.PutUint16(p[8:], b)
+			binary.BigEndian.PutUint16(p[10:], a)
+			return data
+		}, "out of order"},
+		{"shared child", multiLevelDatabase, func(t *testing.T, data []byte) []byte {
+			p := page(data, findPage(t, data, 5))
+			// Point the right-most child at the left child of the first cell.
+			firstCell := binary.BigEndian.Uint16(p[12:])
+			copy(p[8:12], p[firstCell:firstCell+4])
+			return data
+		}, "2nd reference to page"},
+		{"overflow chain", overflowDatabase, func(t *testing.T, data []byte) []byte {
+			// Cut short an overflow chain of several pages.
+			binary.BigEndian.PutUint32(page(data, findOverflowChain(t, data)), 0)
+			return data
+		}, "overflow list length"},
+		{"freelist count", freelistDatabase, func(t *testing.T, data []byte) []byte {
+			binary.BigEndian.PutUint32(data[36:], binary.BigEndian.Uint32(data[36:])+1)
+			return data
+		}, "freelist size"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.corrupt(t, tc.write(t))
+			err := verify.Check(bytes.NewReader(data))
+			if _, ok := err.(verify.Errors); !ok || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want Errors containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// findOverflowChain returns the first page of an overflow chain of a table leaf cell
+// that has more than one page.
+func findOverflowChain(t *testing.T, data []byte) int {
+	t.Helper()
+	for n := 2; n*pageSize <= len(data); n++ {
+		p := page(data, n)
+		if p[0] != 13 {
+			continue
+		}
+		for i := range int(binary.BigEndian.Uint16(p[3:])) {
+			// A cell is the payload size and the rowid, as varints,
+			// followed by the payload stored on the page and the first overflow page number.
+			cell := int(binary.BigEndian.Uint16(p[8+2*i:]))
+			size, sizeLen := uvarint(p[cell:])
+			_, rowidLen := uvarint(p[cell+sizeLen:])
+			local := localPayload(int(size))
+			if int(size)-local > pageSize-4 {
+				return int(binary.BigEndian.Uint32(p[cell+sizeLen+rowidLen+local:]))
+			}
+		}
+	}
+	t.Fatal("no overflow chain of several pages")
+	return 0
+}
+
+// uvarint decodes a SQLite varint, returning it and its length.
+func uvarint(buf []byte) (x uint64, n int) {
+	for n < 8 {
+		b := buf[n]
+		n++
+		x = x<<7 | uint64(b&0x7f)
+		if b < 0x80 {
+			return x, n
+		}
+	}
+	return x<<8 | uint64(buf[8]), 9
+}
+
+// localPayload returns how much of a table leaf cell's payload of size bytes is stored on the page.
+func localPayload(size int) int {
+	maxLocal := pageSize - 35
+	if size <= maxLocal {
+		return size
+	}
+	minLocal := (pageSize-12)*32/255 - 23
+	k := minLocal + (size-minLocal)%(pageSize-4)
+	if k <= maxLocal {
+		return k
+	}
+	return minLocal
+}
@@ -0,0 +1,40 @@
+package rawlite
+
+// WithoutRowidTable represents a WITHOUT ROWID table being created.
+//
+// SQLite stores WITHOUT ROWID tables as index B-trees keyed on the primary key,
+// so they are written the same way as an Index:
+// rows must be written in primary key order,
+// and each IndexStream must be given a disjoint range of primary keys
+// in the order the IndexStreams were opened.
+type WithoutRowidTable struct {
+	index Index
+}
+
+// OpenWithoutRowidTable prepares the database for IndexStreams to begin work
+// on a WITHOUT ROWID table.
+func (db *Database) OpenWithoutRowidTable() *WithoutRowidTable {
+	return &WithoutRowidTable{index: Index{parent: db}}
+}
+
+// OpenStream opens an IndexStream for writing rows to this table.
+// Each row is a record containing the primary key columns in primary key order
+// followed by the remaining columns in the order they were declared.
+// Rows written to the stream must sort after rows written to
+// all previously opened IndexStreams.
+func (t *WithoutRowidTable) OpenStream() *IndexStream {
+	return t.index.OpenStream()
+}
+
+// Close closes the B-tree and informs the Database of the root page number.
+// All IndexStreams must be closed before calling Close.
+//
+// sql is the CREATE TABLE statement, which must end with WITHOUT ROWID.
+func (t *WithoutRowidTable) Close(name, sql string) error {
+	rootPage, err := t.index.closeTree()
+	if err != nil {
+		return err
+	}
+
+	return t.index.parent.addTableSchemaRecord(name, sql, rootPage)
+}
@@ -0,0 +1,62 @@
+package rawlite_test
+
+import (
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"strings"
+	"testing"
+)
+
+// TestWithoutRowidTable checks a WITHOUT ROWID table written by several streams
+// over disjoint ranges of primary keys, with some rows that need overflow pages.
+func TestWithoutRowidTable(t *testing.T) {
+	f := &memFile{}
+	db := rawlite.OpenDatabase(f, rawlite.PageSize(512))
+	tbl := db.OpenWithoutRowidTable()
+	sizes := []int{500, 1, 0, 3, 2000, 6}
+	var streams []*rawlite.IndexStream
+	for range sizes {
+		streams = append(streams, tbl.OpenStream())
+	}
+
+	// Write to the streams in reverse, since only the order they were opened in matters.
+	first := make([]int, len(sizes))
+	for k := 1; k < len(sizes); k++ {
+		first[k] = first[k-1] + sizes[k-1]
+	}
+	for k := len(sizes) - 1; k >= 0; k-- {
+		for i := first[k]; i < first[k]+sizes[k]; i++ {
+			var rec record.Record
+			rec.AppendString(fmt.Sprintf("k%06d", i))
+			rec.AppendString(strings.Repeat("y", i*13%2000))
+			if err := streams[k].WriteRecord(rec.AppendTo(nil)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := streams[k].Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.Close("w", "CREATE TABLE w(k TEXT PRIMARY KEY, v TEXT) WITHOUT ROWID"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkDatabase(t, f)
+
+	n := first[len(sizes)-1] + sizes[len(sizes)-1]
+	if got, want := querySQLite(t, f, "SELECT count(*) FROM w"), fmt.Sprint(n); got != want {
+		t.Errorf("count(*): got %s, want %s", got, want)
+	}
+	for _, i := range []int{0, 499, 500, 501, 503, 1234, n - 1} {
+		sql := fmt.Sprintf("SELECT length(v) FROM w WHERE k = 'k%06d'", i)
+		if got, want := querySQLite(t, f, sql), fmt.Sprint(i*13%2000); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+	if got := querySQLite(t, f, "SELECT count(*) FROM sqlite_schema WHERE name LIKE 'sqlite_autoindex%'"); got != "0" {
+		t.Errorf("sqlite_schema has %s automatic indexes", got)
+	}
+}
@@ -0,0 +1,134 @@
+package rawlite
+
+import (
+	"fmt"
+	"github.com/jordanwade90/rawlite/internal/pagebuf"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// CoalesceWrites makes the Database buffer the pages it writes
+// until threshold bytes of them are pending,
+// and then write each run of consecutive pages with a single WriteAt call.
+// Pages are allocated to streams one at a time as they fill them,
+// so the pages of a run usually come from many streams,
+// and a larger threshold makes for longer runs at the cost of memory.
+// A few megabytes per worker is usually enough.
+//
+// Pages are copied when they are buffered,
+// so buffering only pays off when each WriteAt call is expensive:
+// with small pages, or on network file systems, rather than with 64 KiB pages on a local disk,
+// where copying the data dominates the cost of the system calls.
+// BenchmarkCoalesceWrites compares thresholds at several page sizes.
+// If threshold is negative, the Database fails with an error wrapping ErrInvalidOption.
+// Close writes out the pages that are still buffered.
+func CoalesceWrites(threshold int) DatabaseOption {
+	return func(db *Database) {
+		if threshold < 0 {
+			db.fail(fmt.Errorf("%w: negative write threshold %d", ErrInvalidOption, threshold))
+			return
+		}
+		db.writes = nil
+		if threshold > 0 {
+			db.writes = &writeBuffer{threshold: threshold, pages: make(map[pagebuf.PageNumber][]byte)}
+		}
+	}
+}
+
+// writeBuffer holds the pages buffered by CoalesceWrites.
+type writeBuffer struct {
+	threshold int
+
+	// lock protects pages, size, and free.
+	lock  sync.Mutex
+	pages map[pagebuf.PageNumber][]byte
+	size  int
+	// free holds page buffers to reuse.
+	free [][]byte
+
+	// flushLock is held while writing out a batch of pages,
+	// so that batches are written in the order they were taken
+	// and flush waits for any batch that is being written.
+	flushLock sync.Mutex
+	// run is a reusable buffer for a run of consecutive pages,
+	// and spare is the map of pages taken by the last flush, emptied for reuse.
+	// flushLock protects them.
+	run   []byte
+	spare map[pagebuf.PageNumber][]byte
+}
+
+// add buffers a copy of page, returning whether the buffer has reached the threshold.
+func (w *writeBuffer) add(pageNumber pagebuf.PageNumber, page []byte) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	buf, ok := w.pages[pageNumber]
+	if !ok {
+		if n := len(w.free); n != 0 {
+			buf, w.free = w.free[n-1], w.free[:n-1]
+		} else {
+			buf = make([]byte, len(page))
+		}
+		w.pages[pageNumber] = buf
+		w.size += len(page)
+	}
+	copy(buf, page)
+	return w.size >= w.threshold
+}
+
+// flush writes out the pages buffered by CoalesceWrites, if any,
+// making the Database fail if it can't.
+func (db *Database) flush() error {
+	w := db.writes
+	if w == nil {
+		return db.check()
+	}
+	w.flushLock.Lock()
+	defer w.flushLock.Unlock()
+
+	if w.spare == nil {
+		w.spare = make(map[pagebuf.PageNumber][]byte)
+	}
+	w.lock.Lock()
+	pages := w.pages
+	w.pages, w.spare = w.spare, nil
+	w.size = 0
+	w.lock.Unlock()
+
+	err := db.check()
+	pageNumbers := slices.Sorted(maps.Keys(pages))
+	for i := 0; i < len(pageNumbers); {
+		j := i + 1
+		for j < len(pageNumbers) && pageNumbers[j] == pageNumbers[j-1]+1 {
+			j++
+		}
+		if err == nil {
+			err = db.writeRun(pageNumbers[i:j], pages)
+		}
+		i = j
+	}
+
+	w.lock.Lock()
+	for _, buf := range pages {
+		w.free = append(w.free, buf)
+	}
+	w.lock.Unlock()
+	clear(pages)
+	w.spare = pages
+	return err
+}
+
+// writeRun writes the buffered pages of a run of consecutive page numbers with one WriteAt call.
+// The caller must hold flushLock.
+func (db *Database) writeRun(pageNumbers []pagebuf.PageNumber, pages map[pagebuf.PageNumber][]byte) error {
+	if len(pageNumbers) == 1 {
+		return db.writeAt(pageNumbers[0], pages[pageNumbers[0]])
+	}
+	w := db.writes
+	w.run = w.run[:0]
+	for _, pageNumber := range pageNumbers {
+		w.run = append(w.run, pages[pageNumber]...)
+	}
+	return db.writeAt(pageNumbers[0], w.run)
+}
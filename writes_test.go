@@ -0,0 +1,147 @@
+package rawlite_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jordanwade90/rawlite"
+	"github.com/jordanwade90/rawlite/record"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingFile counts the WriteAt calls to a file.
+type countingFile struct {
+	*os.File
+	writes atomic.Int64
+}
+
+func (f *countingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.writes.Add(1)
+	return f.File.WriteAt(p, off)
+}
+
+// writeInTurns writes rows to two tables from several goroutines at once,
+// each with its own stream, taking turns so that pages are allocated in the same order every time.
+func writeInTurns(t *testing.T, db *rawlite.Database) {
+	t.Helper()
+	const workers, batches, batchSize = 4, 20, 15
+
+	tables := []*rawlite.Table{db.OpenTable(), db.OpenTable()}
+	turns := make([]chan struct{}, workers)
+	for i := range turns {
+		turns[i] = make(chan struct{}, 1)
+	}
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			next := turns[(w+1)%workers]
+			s := tables[w%len(tables)].OpenStream()
+			for b := range batches {
+				<-turns[w]
+				for i := 0; i < batchSize && errs[w] == nil; i++ {
+					_, errs[w] = s.WriteRow(overflowRow((w*batches+b)*batchSize + i))
+				}
+				next <- struct{}{}
+			}
+			<-turns[w]
+			if err := s.Close(); errs[w] == nil {
+				errs[w] = err
+			}
+			next <- struct{}{}
+		}()
+	}
+	turns[0] <- struct{}{}
+	wg.Wait()
+	<-turns[0]
+
+	for w, err := range errs {
+		if err != nil {
+			t.Fatalf("worker %d: %v", w, err)
+		}
+	}
+	for i, tbl := range tables {
+		name := fmt.Sprintf("t%d", i)
+		if err := tbl.Close(name, fmt.Sprintf("CREATE TABLE %s(i INTEGER, s TEXT)", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCoalesceWrites checks that buffering writes doesn't change the database that is written,
+// whether the buffer is flushed after every page, every few pages, or only by Close.
+func TestCoalesceWrites(t *testing.T) {
+	for _, pageSize := range []int{512, 1024, 4096} {
+		want := &memFile{}
+		writeInTurns(t, rawlite.OpenDatabase(want, rawlite.PageSize(pageSize)))
+		checkDatabase(t, want)
+
+		for _, threshold := range []int{1, pageSize, 3 * pageSize, 64 << 10, 1 << 30} {
+			t.Run(fmt.Sprintf("pagesize=%d/threshold=%d", pageSize, threshold), func(t *testing.T) {
+				f := &memFile{}
+				writeInTurns(t, rawlite.OpenDatabase(f, rawlite.PageSize(pageSize), rawlite.CoalesceWrites(threshold)))
+				checkDatabase(t, f)
+				if !bytes.Equal(f.data, want.data) {
+					t.Errorf("got a %d-byte file, want the same %d bytes as without CoalesceWrites", len(f.data), len(want.data))
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCoalesceWrites writes the same rows to a file with and without CoalesceWrites,
+// reporting the number of WriteAt calls.
+func BenchmarkCoalesceWrites(b *testing.B) {
+	const rows, rowSize = 20000, 200
+	text := strings.Repeat("abcdefghijklmnopqrstuvwxyz", rowSize/26+1)[:rowSize]
+	encode := func(rec *record.Record, i int) error {
+		rec.AppendInt(int64(i))
+		rec.AppendString(text)
+		return nil
+	}
+	values := make([]int, rows)
+	for i := range values {
+		values[i] = i
+	}
+
+	for _, pageSize := range []int{512, 1024, 4096} {
+		for _, threshold := range []int{0, 64 << 10, 1 << 20, 4 << 20} {
+			b.Run(fmt.Sprintf("pagesize=%d/threshold=%d", pageSize, threshold), func(b *testing.B) {
+				b.SetBytes(rows * rowSize)
+				name := filepath.Join(b.TempDir(), "bench.db")
+				var writes int64
+				for range b.N {
+					f, err := os.Create(name)
+					if err != nil {
+						b.Fatal(err)
+					}
+					cf := &countingFile{File: f}
+					db := rawlite.OpenDatabase(cf, rawlite.PageSize(pageSize), rawlite.CoalesceWrites(threshold))
+					err = rawlite.Ingest(context.Background(), db.OpenTable(), "t", "CREATE TABLE t(id INTEGER, text TEXT)", slices.Values(values), 0, encode)
+					if closeErr := db.Close(); err == nil {
+						err = closeErr
+					}
+					if closeErr := f.Close(); err == nil {
+						err = closeErr
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+					writes += cf.writes.Load()
+				}
+				b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+			})
+		}
+	}
+}